@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -17,15 +19,18 @@ import (
 	"github.com/tinkeractive/transferless/pkg/compiler"
 	"github.com/tinkeractive/transferless/pkg/configuration"
 	"github.com/tinkeractive/transferless/pkg/enqueuer"
+	"github.com/tinkeractive/transferless/pkg/file"
 	"github.com/tinkeractive/transferless/pkg/job"
-	"github.com/tinkeractive/transferless/pkg/transfer"
+	"github.com/tinkeractive/transferless/pkg/notifier"
+	"github.com/tinkeractive/transferless/pkg/run"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/synchronizer"
 )
 
-// NOTE the on-disk config requirement is unavoidable without altering the rclone source code
-// NOTE the rclone config functionality consists of types with unexported attributes and methods
+// NOTE the config is held in memory and never written to disk
 // NOTE the config can contain fields that are not required by rclone and they will be parsed
 // NOTE rclone obscures passwords before saving in the config file and users must do the same
-// NOTE the aws config provider assumes secrets manager usage
+// NOTE the config provider is a name, a url or a comma separated chain of them, see configuration.ParseProvider
 
 func main() {
 	if "" == os.Getenv("AWS_LAMBDA_FUNCTION_NAME") {
@@ -80,17 +85,11 @@ func CompileJob(inputJob job.Job) {
 	dataRoot := os.Getenv("TRANSFERLESS_DATA_ROOT")
 	transferQueue := os.Getenv("TRANSFERLESS_TRANSFER_QUEUE")
 	remoteConfigService := os.Getenv("TRANSFERLESS_REMOTE_CONFIG_SERVICE")
-	var configProvider interface{}
-	switch remoteConfigService {
-	case "AWSSecretsManager":
-		configProvider = &configuration.AWSSecretsManager{"Type", "Transferless"}
-	case "AWSSystemsManager":
-		configProvider = &configuration.AWSSystemsManager{"Type", "Transferless"}
-	default:
-		log.Println("no credential service specified")
-		return
+	configProvider, err := configuration.ParseProvider(remoteConfigService)
+	if err != nil {
+		log.Fatal(err)
 	}
-	configString, err := configProvider.(configuration.Provider).GetConfig()
+	configString, err := configProvider.GetConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -116,38 +115,120 @@ func CompileJob(inputJob job.Job) {
 	log.Println("getting last mod time")
 	lastModTime, err := compiler.GetLastModTime(remote, dataRoot, inputJob.Name)
 	if err != nil {
-		log.Fatal(err)
+		FailJob(remote, dataRoot, inputJob, err)
 	}
 	log.Println("compiling job transfers")
-	transfers, err := compiler.Compile(inputJob, lastModTime)
+	runTime := time.Now()
+	runID, err := run.NewRunID(runTime)
 	if err != nil {
-		log.Fatal(err)
+		FailJob(remote, dataRoot, inputJob, err)
+	}
+	store, err := state.NewStore(remote, dataRoot)
+	if err != nil {
+		FailJob(remote, dataRoot, inputJob, err)
+	}
+	var transfers, deletions []file.File
+	entries := map[string]map[string][]string{}
+	switch inputJob.GetMode() {
+	case job.ModeCopy:
+		transfers, err = compiler.Compile(inputJob, lastModTime)
+	case job.ModeMirror:
+		transfers, deletions, entries, err = compiler.CompileMirror(inputJob, lastModTime, store)
+	default:
+		err = fmt.Errorf("unknown job mode: %s", inputJob.Mode)
+	}
+	if err != nil {
+		FailJob(remote, dataRoot, inputJob, err)
 	}
 	maxModTime := lastModTime
 	awsEnqueuer, err := enqueuer.NewAWSEnqueuer(region, "", transferQueue)
 	if err != nil {
-		log.Fatal(err)
+		FailJob(remote, dataRoot, inputJob, err)
 	}
 	_ = awsEnqueuer
-	for _, transferFile := range transfers {
-		log.Println("enqueueing:", transferFile)
-		err = awsEnqueuer.EnqueueTransfer(transfer.Transfer{transferFile, inputJob})
+	enqueued := 0
+	var enqueuedBytes int64
+	jobTransfers, err := compiler.GetTransfers(inputJob, transfers, runTime)
+	if err != nil {
+		FailJob(remote, dataRoot, inputJob, err)
+	}
+	compiler.SetMirrorEntries(jobTransfers, entries)
+	jobTransfers = append(jobTransfers, compiler.GetDeleteTransfers(inputJob, deletions, entries, runTime)...)
+	for _, transferObj := range jobTransfers {
+		log.Println("enqueueing:", transferObj.File)
+		transferObj.RunID = runID
+		if len(transferObj.Files) > 0 {
+			transferObj.Members, err = run.PutMembers(store, runID, transferObj.Sequence, transferObj.Files)
+			if err != nil {
+				log.Println("compiler failed to store bundle members:", inputJob, transferObj.File, err)
+				continue
+			}
+			transferObj.Files = nil
+		}
+		err = awsEnqueuer.EnqueueTransfer(transferObj)
 		if err != nil {
-			log.Println("compiler failed to enqueue:", inputJob, transferFile)
+			log.Println("compiler failed to enqueue:", inputJob, transferObj.File)
+			continue
 		}
-		if err == nil && maxModTime < transferFile.LastModified {
-			maxModTime = transferFile.LastModified
+		enqueued++
+		enqueuedBytes += transferObj.File.Size
+		if maxModTime < transferObj.File.LastModified {
+			maxModTime = transferObj.File.LastModified
 		}
 	}
+	// NOTE the run is created once its transfers are enqueued so that only those are expected
+	if enqueued > 0 {
+		err = notifier.PutArrival(store, inputJob, runTime)
+		if err != nil {
+			log.Println("failed to record arrival:", err)
+		}
+		log.Println("creating run:", runID, enqueued)
+		err = run.Create(store, run.Run{ID: runID, Job: inputJob, Expected: enqueued, Bytes: enqueuedBytes, Created: runTime.Unix()})
+		if err != nil {
+			FailJob(remote, dataRoot, inputJob, err)
+		}
+		err = synchronizer.CompleteRun(store, runID)
+		if err != nil {
+			log.Println("failed to complete run:", err)
+		}
+	}
+	log.Println("checking deadline")
+	err = notifier.CheckDeadline(store, inputJob, runTime)
+	if err != nil {
+		log.Println("failed to check deadline:", err)
+	}
 	log.Println("putting max mod time", maxModTime)
 	err = compiler.PutModTime(remote, dataRoot, inputJob.Name, maxModTime)
 	if err != nil {
-		log.Fatal(err)
+		FailJob(remote, dataRoot, inputJob, err)
 	}
 	log.Println("unlocking job")
 	err = compiler.Unlock(remote, dataRoot, inputJob.Name)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// NOTE abandoned resumable uploads are aborted so that their parts are not stored indefinitely
+	log.Println("cleaning up abandoned uploads")
+	err = synchronizer.CleanupUploads(store, synchronizer.DefaultUploadMaxAge)
+	if err != nil {
+		log.Println("failed to clean up uploads:", err)
+	}
 	log.Println("exiting")
 }
+
+// NOTE a compile that fails after locking the job unlocks it and notifies the failure before exiting
+// NOTE so that the next schedule compiles the job again
+func FailJob(remote, dataRoot string, inputJob job.Job, err error) {
+	log.Println("compile failed:", err)
+	log.Println("unlocking job")
+	unlockErr := compiler.Unlock(remote, dataRoot, inputJob.Name)
+	if unlockErr != nil {
+		log.Println("failed to unlock job:", unlockErr)
+	}
+	event := notifier.NewEvent(notifier.EventRunFailed, inputJob.Name, fmt.Sprintf("compile failed: %s", err))
+	notifyErr := notifier.Notify(inputJob, event)
+	if notifyErr != nil {
+		log.Println("failed to notify compile failure:", notifyErr)
+	}
+	log.Fatal(err)
+}
@@ -28,17 +28,11 @@ func HandleRequest() {
 	objPath := os.Getenv("TRANSFERLESS_JOB_CONFIG_PATH")
 	jobQueue := os.Getenv("TRANSFERLESS_JOB_QUEUE")
 	remoteConfigService := os.Getenv("TRANSFERLESS_REMOTE_CONFIG_SERVICE")
-	var configProvider interface{}
-	switch remoteConfigService {
-	case "AWSSecretsManager":
-		configProvider = &configuration.AWSSecretsManager{"Type", "Transferless"}
-	case "AWSSystemsManager":
-		configProvider = &configuration.AWSSystemsManager{"Type", "Transferless"}
-	default:
-		log.Println("no credential service specified")
-		return
+	configProvider, err := configuration.ParseProvider(remoteConfigService)
+	if err != nil {
+		log.Fatal(err)
 	}
-	configString, err := configProvider.(configuration.Provider).GetConfig()
+	configString, err := configProvider.GetConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -14,6 +16,8 @@ import (
 	_ "github.com/rclone/rclone/backend/s3"
 	_ "github.com/rclone/rclone/backend/sftp"
 	"github.com/tinkeractive/transferless/pkg/configuration"
+	"github.com/tinkeractive/transferless/pkg/enqueuer"
+	"github.com/tinkeractive/transferless/pkg/state"
 	"github.com/tinkeractive/transferless/pkg/synchronizer"
 	"github.com/tinkeractive/transferless/pkg/transfer"
 )
@@ -36,6 +40,7 @@ func main() {
 		receiveMessageInput := &sqs.ReceiveMessageInput{
 			QueueUrl:            aws.String(*getQueueURLOutput.QueueUrl),
 			MaxNumberOfMessages: aws.Int64(int64(1)),
+			AttributeNames:      aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount}),
 		}
 		receiveMessageOutput, err := sqsClient.ReceiveMessage(receiveMessageInput)
 		if err != nil {
@@ -46,48 +51,105 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		SyncTransfer(transferObj)
+		receiveCount, _ := strconv.Atoi(aws.StringValue(receiveMessageOutput.Messages[0].Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+		err = SyncTransfer(context.Background(), transferQueue, receiveCount, transferObj)
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		lambda.Start(HandleRequest)
 	}
 }
 
-func HandleRequest(lambdaEvent events.SQSEvent) {
+// NOTE a returned error fails the invocation so that the queue redelivers the batch
+func HandleRequest(ctx context.Context, lambdaEvent events.SQSEvent) error {
 	for _, event := range lambdaEvent.Records {
 		var transferObj transfer.Transfer
 		err := json.Unmarshal([]byte(event.Body), &transferObj)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		// NOTE the queue name is the last element of the event source arn
+		arnParts := strings.Split(event.EventSourceARN, ":")
+		receiveCount, _ := strconv.Atoi(event.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount])
+		err = SyncTransfer(ctx, arnParts[len(arnParts)-1], receiveCount, transferObj)
+		if err != nil {
+			return err
 		}
-		SyncTransfer(transferObj)
 	}
+	return nil
 }
 
-func SyncTransfer(transferObj transfer.Transfer) {
+// NOTE the invocation deadline lets long transfers checkpoint and stop before the runtime kills them
+// NOTE the receive count tells the last delivery before the dead letter queue so that the failure is recorded with the run
+func SyncTransfer(ctx context.Context, transferQueue string, receiveCount int, transferObj transfer.Transfer) error {
 	log.Println("transfer:", transferObj)
 	remoteConfigService := os.Getenv("TRANSFERLESS_REMOTE_CONFIG_SERVICE")
-	var configProvider interface{}
-	switch remoteConfigService {
-	case "AWSSecretsManager":
-		configProvider = &configuration.AWSSecretsManager{"Type", "Transferless"}
-	case "AWSSystemsManager":
-		configProvider = &configuration.AWSSystemsManager{"Type", "Transferless"}
-	default:
-		log.Println("no credential service specified")
-		return
+	configProvider, err := configuration.ParseProvider(remoteConfigService)
+	if err != nil {
+		return err
 	}
-	configString, err := configProvider.(configuration.Provider).GetConfig()
+	configString, err := configProvider.GetConfig()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	log.Println("loading config")
 	err = configuration.LoadConfig(context.Background(), configString)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	log.Println("synchronizing transfer")
-	err = synchronizer.Sync(transferObj)
+	synchronizer.CloseSFTPClients()
+	opts := synchronizer.Options{}
+	opts.Deadline, _ = ctx.Deadline()
+	rawRemote := os.Getenv("TRANSFERLESS_DATA_REMOTE")
+	if rawRemote != "" {
+		opts.Store, err = state.NewStore(rawRemote, os.Getenv("TRANSFERLESS_DATA_ROOT"))
+		if err != nil {
+			return err
+		}
+	}
+	// NOTE a deferred bundle is enqueued again as it was received, without its members
+	message := transferObj
+	transferObj, err = synchronizer.LoadMembers(transferObj, opts.Store)
+	if err != nil {
+		return err
+	}
+	transferObj, err = synchronizer.SetProcessTime(transferObj, opts.Store)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	message.ProcessTime = transferObj.ProcessTime
+	log.Println("synchronizing transfer")
+	err = synchronizer.Sync(transferObj, opts)
+	if err == nil {
+		return synchronizer.FinishTransfer(transferObj, opts, nil)
+	}
+	class := synchronizer.Classify(err)
+	log.Println(class, "transfer failure:", err)
+	// NOTE a permanent failure would fail again on redelivery so the message is consumed
+	if class == synchronizer.Permanent {
+		return synchronizer.FinishTransfer(transferObj, opts, err)
+	}
+	awsEnqueuer, enqueuerErr := enqueuer.NewAWSEnqueuer(os.Getenv("AWS_REGION"), "", transferQueue)
+	if enqueuerErr != nil {
+		return enqueuerErr
+	}
+	// NOTE a deferred or incomplete transfer is enqueued again so that it does not count towards the redrive limit
+	if class == synchronizer.Deferred {
+		delay := synchronizer.GetDeferDelay()
+		log.Println("deferring transfer for", delay)
+		return awsEnqueuer.DeferTransfer(message, delay)
+	}
+	// NOTE the failure is recorded on the last delivery and still returned so that the message reaches the dead letter queue
+	maxReceiveCount, countErr := awsEnqueuer.GetMaxReceiveCount()
+	if countErr != nil {
+		log.Println("failed to get max receive count:", countErr)
+	} else if maxReceiveCount > 0 && receiveCount >= maxReceiveCount {
+		log.Println("last delivery of transfer, recording failure")
+		finishErr := synchronizer.FinishTransfer(transferObj, opts, err)
+		if finishErr != nil {
+			log.Println("failed to finish transfer:", finishErr)
+		}
 	}
+	return err
 }
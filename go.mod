@@ -3,10 +3,18 @@ module github.com/tinkeractive/transferless
 go 1.16
 
 require (
+	github.com/ProtonMail/go-crypto v1.0.0
+	github.com/Unknwon/goconfig v0.0.0-20200908083735-df7de6a44db8
 	github.com/abbot/go-http-auth v0.4.0 // indirect
 	github.com/aws/aws-lambda-go v1.24.0
 	github.com/aws/aws-sdk-go v1.40.27
+	github.com/dsnet/compress v0.0.1
 	github.com/go-ini/ini v1.62.0
+	github.com/klauspost/compress v1.13.4
 	github.com/mattn/go-colorable v0.1.8 // indirect
+	github.com/pkg/sftp v1.13.2
 	github.com/rclone/rclone v1.57.0
+	golang.org/x/crypto v0.7.0
+	golang.org/x/text v0.8.0
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 )
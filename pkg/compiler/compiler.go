@@ -3,10 +3,13 @@ package compiler
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +20,9 @@ import (
 	"github.com/rclone/rclone/fs/operations"
 	"github.com/tinkeractive/transferless/pkg/file"
 	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/mirror"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
 )
 
 func IsTransferCandidate(modTime, minModTime int64) bool {
@@ -136,6 +142,15 @@ func PutModTime(remote, dataRoot, jobName string, modTime int64) error {
 }
 
 func Compile(transferJob job.Job, lastModTime int64) ([]file.File, error) {
+	transfers, err := List(transferJob, lastModTime)
+	if err != nil {
+		return transfers, err
+	}
+	return FilterDates(transferJob.Source, transfers)
+}
+
+// NOTE the listing only applies the source pattern and mod time, not the date filters of the source
+func List(transferJob job.Job, lastModTime int64) ([]file.File, error) {
 	transfers := []file.File{}
 	ctx, err := NewContext()
 	if err != nil {
@@ -151,7 +166,10 @@ func Compile(transferJob job.Job, lastModTime int64) ([]file.File, error) {
 	if err != nil {
 		return transfers, err
 	}
-	operations.ListFn(ctx, fsrc, Filter(lastModTime, re, &transfers))
+	err = operations.ListFn(ctx, fsrc, Filter(lastModTime, re, NeedsHash(transferJob), &transfers))
+	if err != nil {
+		return transfers, err
+	}
 	//	listJSONOpt := operations.ListJSONOpt{NoModTime: false}
 	//	err = operations.ListJSON(ctx, fsrc, transferJob.Source.Remote, &listJSONOpt, NewFilter(lastModTime, re, &transfers))
 	//	if err != nil {
@@ -160,6 +178,259 @@ func Compile(transferJob job.Job, lastModTime int64) ([]file.File, error) {
 	return transfers, nil
 }
 
+const DefaultMaxDeletePercent = 50
+
+// NOTE mirrored jobs list the whole source so that a file a target has not received is copied whatever its mod time
+// NOTE files a target received whose source is no longer listed are deleted, so a rename is a copy and a delete
+// NOTE bundle targets are not mirrored and the first run copies every file because nothing has been recorded yet
+// NOTE the recorded entry keys are returned by source key and target key so that transfers carry them
+// NOTE a source file outside the date filters is still listed so what it delivered is kept, it is only not copied
+func CompileMirror(transferJob job.Job, lastModTime int64, store *state.Store) ([]file.File, []file.File, map[string]map[string][]string, error) {
+	transfers := []file.File{}
+	deletions := []file.File{}
+	entries := map[string]map[string][]string{}
+	err := ValidateMirror(transferJob)
+	if err != nil {
+		return transfers, deletions, entries, err
+	}
+	listing, err := List(transferJob, -1)
+	if err != nil {
+		return transfers, deletions, entries, err
+	}
+	listed := map[string]bool{}
+	for _, f := range listing {
+		listed[mirror.GetSourceKey(f.Name)] = true
+	}
+	files, err := FilterDates(transferJob.Source, listing)
+	if err != nil {
+		return transfers, deletions, entries, err
+	}
+	recorded := map[string]bool{}
+	missing := map[string]bool{}
+	orphans := map[string]mirror.Entry{}
+	for _, target := range transferJob.Targets {
+		if target.IsBundled() {
+			continue
+		}
+		keys, err := mirror.ListKeys(store, transferJob.Name, target)
+		if err != nil {
+			return transfers, deletions, entries, err
+		}
+		targetKey := mirror.GetTargetKey(target)
+		received := map[string]bool{}
+		for _, key := range keys {
+			sourceKey := mirror.GetEntrySource(key)
+			received[sourceKey] = true
+			recorded[sourceKey] = true
+			if entries[sourceKey] == nil {
+				entries[sourceKey] = map[string][]string{}
+			}
+			entries[sourceKey][targetKey] = append(entries[sourceKey][targetKey], key)
+			if _, ok := orphans[sourceKey]; listed[sourceKey] || ok {
+				continue
+			}
+			orphans[sourceKey], err = mirror.Get(store, transferJob.Name, target, key)
+			if err != nil {
+				return transfers, deletions, entries, err
+			}
+		}
+		for sourceKey := range listed {
+			if !received[sourceKey] {
+				missing[sourceKey] = true
+			}
+		}
+	}
+	maxDeletePercent := transferJob.MaxDeletePercent
+	if maxDeletePercent <= 0 {
+		maxDeletePercent = DefaultMaxDeletePercent
+	}
+	if len(orphans) > 0 && len(orphans)*100 > maxDeletePercent*len(recorded) {
+		return transfers, deletions, entries, fmt.Errorf("mirror would delete %d of %d files, more than %d%%", len(orphans), len(recorded), maxDeletePercent)
+	}
+	for _, f := range files {
+		if IsTransferCandidate(f.LastModified, lastModTime) || missing[mirror.GetSourceKey(f.Name)] {
+			transfers = append(transfers, f)
+		}
+	}
+	for _, entry := range orphans {
+		deletions = append(deletions, file.File{Name: entry.Source})
+	}
+	sort.Slice(deletions, func(i, j int) bool {
+		return deletions[i].Name < deletions[j].Name
+	})
+	return transfers, deletions, entries, nil
+}
+
+// NOTE deletions follow the source so it must not be removed or moved by a post action, extracted entries are not recorded
+func ValidateMirror(transferJob job.Job) error {
+	switch transferJob.Source.GetPostAction() {
+	case job.PostActionDelete, job.PostActionArchive, job.PostActionRename:
+		return fmt.Errorf("mirror cannot be used with the %s post action", transferJob.Source.GetPostAction())
+	}
+	if transferJob.Source.Extract != "" {
+		return errors.New("mirror cannot be used with extraction")
+	}
+	return nil
+}
+
+// NOTE file dates are compared in utc because the compiler has no target zone
+// NOTE the range includes its start and excludes its end
+// NOTE dates come from the date pattern or the date capture groups of the source pattern, as target paths read them
+// NOTE files without a date fail the compile when so configured and the job is unlocked before it exits
+func FilterDates(source job.JobSource, files []file.File) ([]file.File, error) {
+	if !source.IsDateFiltered() {
+		return files, nil
+	}
+	result := []file.File{}
+	from, err := ParseDateBound(source.DateFrom)
+	if err != nil {
+		return result, err
+	}
+	to, err := ParseDateBound(source.DateTo)
+	if err != nil {
+		return result, err
+	}
+	invalid := []string{}
+	for _, f := range files {
+		date, err := source.GetFileNameDate(f.Name, time.UTC)
+		if err != nil {
+			switch source.OnDateError {
+			case job.DateErrorFail:
+				invalid = append(invalid, f.Name)
+			case job.DateErrorModTime:
+				log.Println("using mod time for file without date:", f.Name)
+				result = append(result, f)
+			default:
+				log.Println("skipping file without date:", f.Name)
+			}
+			continue
+		}
+		if IsInDateRange(date, from, to) {
+			result = append(result, f)
+		}
+	}
+	if len(invalid) > 0 {
+		return result, fmt.Errorf("no date in file names: %s", strings.Join(invalid, ", "))
+	}
+	return result, nil
+}
+
+func ParseDateBound(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	result, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return result, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func IsInDateRange(date, from, to time.Time) bool {
+	if !from.IsZero() && date.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !date.Before(to) {
+		return false
+	}
+	return true
+}
+
+// NOTE targets that pack or concatenate a run receive one bundle transfer instead of a transfer per file
+// NOTE bundled targets that select the same files share a bundle and a target that selects none receives nothing
+func GetTransfers(transferJob job.Job, files []file.File, runTime time.Time) ([]transfer.Transfer, error) {
+	transfers := []transfer.Transfer{}
+	fileJob := transferJob
+	fileJob.Targets = []job.JobTarget{}
+	bundleKeys := []string{}
+	bundleJobs := map[string]job.Job{}
+	bundleFiles := map[string][]file.File{}
+	for _, target := range transferJob.Targets {
+		if !target.IsBundled() {
+			fileJob.Targets = append(fileJob.Targets, target)
+			continue
+		}
+		members := []file.File{}
+		names := []string{}
+		for _, transferFile := range files {
+			ok, err := target.IsBundleMember(transferFile.Name)
+			if err != nil {
+				return transfers, err
+			}
+			if ok {
+				members = append(members, transferFile)
+				names = append(names, transferFile.Name)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		key := strings.Join(names, "\n")
+		bundleJob, ok := bundleJobs[key]
+		if !ok {
+			bundleJob = transferJob
+			bundleJob.Targets = []job.JobTarget{}
+			bundleKeys = append(bundleKeys, key)
+			bundleFiles[key] = members
+		}
+		bundleJob.Targets = append(bundleJob.Targets, target)
+		bundleJobs[key] = bundleJob
+	}
+	if len(fileJob.Targets) > 0 {
+		for i, transferFile := range files {
+			transfers = append(transfers, transfer.Transfer{
+				File:     transferFile,
+				Job:      fileJob,
+				Sequence: i + 1,
+				RunTime:  runTime.Unix(),
+			})
+		}
+	}
+	for i, key := range bundleKeys {
+		bundle := file.File{Name: transferJob.Name}
+		for _, transferFile := range bundleFiles[key] {
+			bundle.Size += transferFile.Size
+			if bundle.LastModified < transferFile.LastModified {
+				bundle.LastModified = transferFile.LastModified
+			}
+		}
+		transfers = append(transfers, transfer.Transfer{
+			File:     bundle,
+			Job:      bundleJobs[key],
+			Files:    bundleFiles[key],
+			Sequence: i + 1,
+			RunTime:  runTime.Unix(),
+		})
+	}
+	return transfers, nil
+}
+
+// NOTE deletions are delivered to the file targets of the job, bundles are not mirrored
+func GetDeleteTransfers(transferJob job.Job, deletions []file.File, entries map[string]map[string][]string, runTime time.Time) []transfer.Transfer {
+	transfers := []transfer.Transfer{}
+	deleteJob := transferJob
+	deleteJob.Targets = []job.JobTarget{}
+	for _, target := range transferJob.Targets {
+		if !target.IsBundled() {
+			deleteJob.Targets = append(deleteJob.Targets, target)
+		}
+	}
+	if len(deleteJob.Targets) == 0 {
+		return transfers
+	}
+	for i, deletion := range deletions {
+		transfers = append(transfers, transfer.Transfer{
+			File:      deletion,
+			Job:       deleteJob,
+			Sequence:  i + 1,
+			RunTime:   runTime.Unix(),
+			Operation: transfer.OperationDelete,
+			Entries:   entries[mirror.GetSourceKey(deletion.Name)],
+		})
+	}
+	return transfers
+}
+
 func NewContext() (context.Context, error) {
 	fi, err := filter.NewFilter(nil)
 	if err != nil {
@@ -168,12 +439,25 @@ func NewContext() (context.Context, error) {
 	return filter.ReplaceConfig(context.Background(), fi), nil
 }
 
-func Filter(lastModTime int64, re *regexp.Regexp, transfers *[]file.File) func(fs.Object) {
+// NOTE hashes can be expensive to read on some backends so they are only recorded when a target pattern uses them
+func NeedsHash(transferJob job.Job) bool {
+	for _, target := range transferJob.Targets {
+		if strings.Contains(target.Pattern, ".Hash") {
+			return true
+		}
+	}
+	return false
+}
+
+func Filter(lastModTime int64, re *regexp.Regexp, withHash bool, transfers *[]file.File) func(fs.Object) {
 	return func(obj fs.Object) {
 		if PathMatchesRegex(obj.String(), re) {
 			modTime := obj.ModTime(context.Background()).Unix()
 			if IsTransferCandidate(modTime, lastModTime) {
-				f := file.File{obj.String(), obj.Size(), modTime}
+				f := file.File{Name: obj.String(), Size: obj.Size(), LastModified: modTime}
+				if withHash {
+					f.Hash, _ = obj.Hash(context.Background(), obj.Fs().Hashes().GetOne())
+				}
 				*transfers = append(*transfers, f)
 			}
 		}
@@ -186,3 +470,12 @@ func Filter(lastModTime int64, re *regexp.Regexp, transfers *[]file.File) func(f
 // 		return nil
 // 	}
 // }
+
+// NOTE a redelivered source prunes the objects it no longer delivers to so its transfer carries its recorded entries
+func SetMirrorEntries(transfers []transfer.Transfer, entries map[string]map[string][]string) {
+	for i := range transfers {
+		if len(transfers[i].Files) == 0 {
+			transfers[i].Entries = entries[mirror.GetSourceKey(transfers[i].File.Name)]
+		}
+	}
+}
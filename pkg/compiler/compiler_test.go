@@ -0,0 +1,55 @@
+package compiler
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/rclone/rclone/backend/local"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/mirror"
+	"github.com/tinkeractive/transferless/pkg/state"
+)
+
+func TestCompileMirrorKeepsFilesOutsideDates(t *testing.T) {
+	sourceDir := t.TempDir()
+	for _, name := range []string{"data_20240101.csv", "data_20240301.csv"} {
+		err := os.WriteFile(filepath.Join(sourceDir, name), []byte("a\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := state.NewStore(":local", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := job.JobTarget{Remote: "target", Root: "out"}
+	transferJob := job.Job{
+		Name: "dated",
+		Mode: job.ModeMirror,
+		Source: job.JobSource{
+			Remote:      ":local",
+			Root:        sourceDir,
+			Pattern:     `data_(?P<year>\d{4})(?P<month>\d{2})(?P<day>\d{2})\.csv$`,
+			DateFrom:    "2024-02-01",
+			OnDateError: job.DateErrorSkip,
+		},
+		Targets: []job.JobTarget{target},
+	}
+	for _, name := range []string{"data_20240101.csv", "data_20240301.csv"} {
+		err = mirror.Put(store, transferJob.Name, target, mirror.Entry{Source: name, Path: "out/" + name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	transfers, deletions, _, err := CompileMirror(transferJob, -1, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletions) != 0 {
+		t.Errorf("file outside the date range was deleted: %v", deletions)
+	}
+	if len(transfers) != 1 || transfers[0].Name != "data_20240301.csv" {
+		t.Errorf("expected only the file in the date range to be copied: %v", transfers)
+	}
+}
@@ -3,7 +3,8 @@ package configuration
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -14,135 +15,200 @@ import (
 	"github.com/go-ini/ini"
 )
 
+// NOTE secrets and parameters are json objects of config keys and become sections named without the prefix or slashes
+// NOTE a prefix or a tag filter is required so that unrelated secrets and parameters are never read as config
+// NOTE the region defaults to that of the function
 type AWSSecretsManager struct {
 	TagKey   string
 	TagValue string
+	Prefix   string
+	Region   string
+}
+
+func NewAWSSecretsManager(opts Options) (Provider, error) {
+	err := opts.Check("tag_key", "tag_value", "prefix", "region")
+	if err != nil {
+		return nil, err
+	}
+	result := &AWSSecretsManager{
+		TagKey:   opts.Get("tag_key", ""),
+		TagValue: opts.Get("tag_value", ""),
+		Prefix:   opts.Get("prefix", ""),
+		Region:   opts.Get("region", os.Getenv("AWS_REGION")),
+	}
+	return result, ValidateFilter("secretsmanager", result.TagKey, result.TagValue, result.Prefix)
 }
 
 func (a *AWSSecretsManager) GetConfig() (string, error) {
 	secretsClient := secretsmanager.New(session.New(), &aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
+		Region: aws.String(a.Region),
 	})
-	// TODO filter only if tag key specified
-	secretsFilter := []*secretsmanager.Filter{
-		{
+	secretsFilter := []*secretsmanager.Filter{}
+	if a.TagKey != "" {
+		secretsFilter = append(secretsFilter, &secretsmanager.Filter{
 			Key:    aws.String("tag-key"),
 			Values: aws.StringSlice([]string{a.TagKey}),
-		},
-		{
+		})
+	}
+	if a.TagValue != "" {
+		secretsFilter = append(secretsFilter, &secretsmanager.Filter{
 			Key:    aws.String("tag-value"),
 			Values: aws.StringSlice([]string{a.TagValue}),
-		},
+		})
 	}
-	input := &secretsmanager.ListSecretsInput{
-		Filters: secretsFilter,
+	if a.Prefix != "" {
+		secretsFilter = append(secretsFilter, &secretsmanager.Filter{
+			Key:    aws.String("name"),
+			Values: aws.StringSlice([]string{a.Prefix}),
+		})
 	}
-	secrets, err := secretsClient.ListSecrets(input)
-	if err != nil {
-		return "", err
+	input := &secretsmanager.ListSecretsInput{}
+	if len(secretsFilter) > 0 {
+		input.Filters = secretsFilter
 	}
-	iniFile, err := ini.Load([]byte{})
+	names := []string{}
+	err := secretsClient.ListSecretsPages(input, func(page *secretsmanager.ListSecretsOutput, lastPage bool) bool {
+		for _, secretListEntry := range page.SecretList {
+			names = append(names, *secretListEntry.Name)
+		}
+		return true
+	})
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	for _, secretListEntry := range secrets.SecretList {
+	iniFile := ini.Empty()
+	for _, name := range names {
+		// NOTE the name filter is not case sensitive so the prefix is checked again
+		if !strings.HasPrefix(name, a.Prefix) {
+			continue
+		}
 		input := &secretsmanager.GetSecretValueInput{
-			SecretId: aws.String(*secretListEntry.Name),
+			SecretId: aws.String(name),
 		}
 		secretValue, err := secretsClient.GetSecretValue(input)
 		if err != nil {
 			return "", err
 		}
-		var secretInterface map[string]interface{}
-		err = json.Unmarshal([]byte(*secretValue.SecretString), &secretInterface)
+		err = AddSection(iniFile, GetSectionName(name, a.Prefix), *secretValue.SecretString)
 		if err != nil {
 			return "", err
 		}
-		sectionName := strings.ReplaceAll(*secretListEntry.Name, "/", "")
-		section, err := iniFile.NewSection(sectionName)
-		if err != nil {
-			return "", err
-		}
-		for key, value := range secretInterface {
-			_, err := section.NewKey(key, value.(string))
-			if err != nil {
-				return "", err
-			}
-		}
-	}
-	var byt []byte
-	buf := bytes.NewBuffer(byt)
-	_, err = iniFile.WriteTo(buf)
-	if err != nil {
-		return "", nil
-	}
-	iniBytes, err := ioutil.ReadAll(buf)
-	if err != nil {
-		return "", err
 	}
-	return string(iniBytes), err
+	return WriteINI(iniFile)
 }
 
 type AWSSystemsManager struct {
 	TagKey   string
 	TagValue string
+	Prefix   string
+	Region   string
+}
+
+// NOTE parameter tag filters match a key and value so a tag key needs a tag value
+func NewAWSSystemsManager(opts Options) (Provider, error) {
+	err := opts.Check("tag_key", "tag_value", "prefix", "region")
+	if err != nil {
+		return nil, err
+	}
+	result := &AWSSystemsManager{
+		TagKey:   opts.Get("tag_key", ""),
+		TagValue: opts.Get("tag_value", ""),
+		Prefix:   opts.Get("prefix", ""),
+		Region:   opts.Get("region", os.Getenv("AWS_REGION")),
+	}
+	if result.TagKey != "" && result.TagValue == "" {
+		return nil, errors.New("ssm config provider tag_key requires tag_value")
+	}
+	return result, ValidateFilter("ssm", result.TagKey, result.TagValue, result.Prefix)
 }
 
+// NOTE secure string parameters are decrypted
 func (a *AWSSystemsManager) GetConfig() (string, error) {
 	ssmClient := ssm.New(session.New(), &aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
+		Region: aws.String(a.Region),
 	})
-	// create DescribeParametersInput with filter and DescribeParameters
-	parameterStringFilter := []*ssm.ParameterStringFilter{
-		{
+	parameterStringFilter := []*ssm.ParameterStringFilter{}
+	if a.TagKey != "" {
+		parameterStringFilter = append(parameterStringFilter, &ssm.ParameterStringFilter{
 			Key:    aws.String("tag:" + a.TagKey),
 			Values: aws.StringSlice([]string{a.TagValue}),
-		},
+		})
 	}
-	input := &ssm.DescribeParametersInput{
-		ParameterFilters: parameterStringFilter,
+	if a.Prefix != "" {
+		parameterStringFilter = append(parameterStringFilter, &ssm.ParameterStringFilter{
+			Key:    aws.String("Name"),
+			Option: aws.String("BeginsWith"),
+			Values: aws.StringSlice([]string{a.Prefix}),
+		})
 	}
-	parameters, err := ssmClient.DescribeParameters(input)
-	if err != nil {
-		return "", err
+	input := &ssm.DescribeParametersInput{}
+	if len(parameterStringFilter) > 0 {
+		input.ParameterFilters = parameterStringFilter
 	}
-	iniFile, err := ini.Load([]byte{})
+	names := []string{}
+	err := ssmClient.DescribeParametersPages(input, func(page *ssm.DescribeParametersOutput, lastPage bool) bool {
+		for _, parameterMeta := range page.Parameters {
+			names = append(names, *parameterMeta.Name)
+		}
+		return true
+	})
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	for _, parameterMeta := range parameters.Parameters {
+	iniFile := ini.Empty()
+	for _, name := range names {
 		input := &ssm.GetParameterInput{
-			Name: aws.String(*parameterMeta.Name),
+			Name:           aws.String(name),
+			WithDecryption: aws.Bool(true),
 		}
 		output, err := ssmClient.GetParameter(input)
 		if err != nil {
 			return "", err
 		}
-		var parameterInterface map[string]interface{}
-		err = json.Unmarshal([]byte(*output.Parameter.Value), &parameterInterface)
+		err = AddSection(iniFile, GetSectionName(name, a.Prefix), *output.Parameter.Value)
 		if err != nil {
 			return "", err
 		}
-		section, err := iniFile.NewSection(*output.Parameter.Name)
-		if err != nil {
-			return "", err
-		}
-		for key, value := range parameterInterface {
-			_, err := section.NewKey(key, value.(string))
-			if err != nil {
-				return "", err
-			}
-		}
 	}
-	var byt []byte
-	buf := bytes.NewBuffer(byt)
-	_, err = iniFile.WriteTo(buf)
+	return WriteINI(iniFile)
+}
+
+func ValidateFilter(name, tagKey, tagValue, prefix string) error {
+	if tagValue != "" && tagKey == "" {
+		return fmt.Errorf("%s config provider tag_value requires tag_key", name)
+	}
+	if tagKey == "" && prefix == "" {
+		return fmt.Errorf("%s config provider requires a prefix or tag_key", name)
+	}
+	return nil
+}
+
+// NOTE ini sections cannot have forward slash in the name
+func GetSectionName(name, prefix string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, prefix), "/", "")
+}
+
+func AddSection(iniFile *ini.File, sectionName, value string) error {
+	var values map[string]interface{}
+	err := json.Unmarshal([]byte(value), &values)
 	if err != nil {
-		return "", nil
+		return err
 	}
-	iniBytes, err := ioutil.ReadAll(buf)
+	section, err := iniFile.NewSection(sectionName)
 	if err != nil {
-		return "", err
+		return err
+	}
+	for key, value := range values {
+		_, err := section.NewKey(key, fmt.Sprint(value))
+		if err != nil {
+			return err
+		}
 	}
-	return string(iniBytes), err
+	return nil
+}
+
+func WriteINI(iniFile *ini.File) (string, error) {
+	var buf bytes.Buffer
+	_, err := iniFile.WriteTo(&buf)
+	return buf.String(), err
 }
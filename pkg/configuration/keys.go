@@ -0,0 +1,88 @@
+package configuration
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/obscure"
+)
+
+// NOTE keys are config sections alongside the rclone remotes and are delivered by the same providers
+// NOTE key values are armored with escaped newlines or base64 encoded binary keys
+// NOTE the passphrase must be obscured the same way as rclone passwords
+func GetKeyRing(names []string) (openpgp.EntityList, error) {
+	var result openpgp.EntityList
+	for _, name := range names {
+		entities, err := GetKey(name)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, entities...)
+	}
+	return result, nil
+}
+
+func GetKey(name string) (openpgp.EntityList, error) {
+	var result openpgp.EntityList
+	keyType, _ := config.FileGetFlag(name, "type")
+	if keyType != "pgp" {
+		return result, fmt.Errorf("config section is not a pgp key: %s", name)
+	}
+	value, isPrivate := config.FileGetFlag(name, "private_key")
+	if !isPrivate {
+		value, _ = config.FileGetFlag(name, "public_key")
+	}
+	result, err := ReadKeyRing(value)
+	if err != nil {
+		return result, fmt.Errorf("reading pgp key %s: %w", name, err)
+	}
+	if !isPrivate {
+		return result, nil
+	}
+	passphrase, ok := config.FileGetFlag(name, "passphrase")
+	if !ok {
+		return result, nil
+	}
+	revealed, err := obscure.Reveal(passphrase)
+	if err != nil {
+		return result, err
+	}
+	err = DecryptKeyRing(result, []byte(revealed))
+	return result, err
+}
+
+func ReadKeyRing(value string) (openpgp.EntityList, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		armored := strings.ReplaceAll(value, `\n`, "\n")
+		return openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return openpgp.ReadKeyRing(bytes.NewReader(decoded))
+}
+
+func DecryptKeyRing(entities openpgp.EntityList, passphrase []byte) error {
+	for _, entity := range entities {
+		if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
+			err := entity.PrivateKey.Decrypt(passphrase)
+			if err != nil {
+				return err
+			}
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				err := subkey.PrivateKey.Decrypt(passphrase)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -2,23 +2,17 @@ package configuration
 
 import (
 	"context"
-
-	"github.com/rclone/rclone/fs/config/configfile"
 )
 
 type Provider interface {
 	GetConfig() (string, error)
 }
 
+// NOTE the config is installed as in-memory storage and replaces any config loaded before it
 func LoadConfig(ctx context.Context, cfg string) error {
-	configManager, err := NewManager()
-	if err != nil {
-		return err
-	}
-	err = configManager.SaveConfig(cfg)
+	storage, err := NewStorage(cfg)
 	if err != nil {
 		return err
 	}
-	configfile.Install()
-	return nil
+	return storage.Install()
 }
@@ -0,0 +1,143 @@
+package configuration
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Unknwon/goconfig"
+)
+
+// NOTE options are the query values of a provider url with the url path as the prefix option
+type Options map[string]string
+
+func (o Options) Get(key, defaultValue string) string {
+	if value, ok := o[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// NOTE an unknown option is more likely a typo than something to ignore so it fails the provider
+func (o Options) Check(keys ...string) error {
+	known := map[string]bool{}
+	for _, key := range keys {
+		known[key] = true
+	}
+	for key := range o {
+		if !known[key] {
+			return fmt.Errorf("unknown config provider option: %s", key)
+		}
+	}
+	return nil
+}
+
+// NOTE provider names are matched without case because url schemes are lower case
+// NOTE the original names keep their tag filter of Type=Transferless so that existing deployments are unchanged
+var Providers = map[string]func(Options) (Provider, error){
+	"secretsmanager":    NewAWSSecretsManager,
+	"ssm":               NewAWSSystemsManager,
+	"awssecretsmanager": WithDefaults(NewAWSSecretsManager, Options{"tag_key": "Type", "tag_value": "Transferless"}),
+	"awssystemsmanager": WithDefaults(NewAWSSystemsManager, Options{"tag_key": "Type", "tag_value": "Transferless"}),
+}
+
+func Register(name string, newProvider func(Options) (Provider, error)) {
+	Providers[strings.ToLower(name)] = newProvider
+}
+
+func WithDefaults(newProvider func(Options) (Provider, error), defaults Options) func(Options) (Provider, error) {
+	return func(opts Options) (Provider, error) {
+		merged := Options{}
+		for key, value := range defaults {
+			merged[key] = value
+		}
+		for key, value := range opts {
+			merged[key] = value
+		}
+		return newProvider(merged)
+	}
+}
+
+func NewProvider(name string, opts Options) (Provider, error) {
+	newProvider, ok := Providers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown config provider: %s", name)
+	}
+	return newProvider(opts)
+}
+
+// NOTE a provider is a name or a url such as ssm:///transferless/?region=eu-west-1&tag_key=Type&tag_value=Transferless
+// NOTE several providers separated by commas form a chain
+func ParseProvider(value string) (Provider, error) {
+	chain := Chain{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, err := ParseProviderURL(part)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, provider)
+	}
+	switch len(chain) {
+	case 0:
+		return nil, errors.New("no config provider specified")
+	case 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+func ParseProviderURL(value string) (Provider, error) {
+	if !strings.Contains(value, "://") {
+		return NewProvider(value, Options{})
+	}
+	providerURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	opts := Options{}
+	for key, values := range providerURL.Query() {
+		opts[key] = values[len(values)-1]
+	}
+	if prefix := providerURL.Host + providerURL.Path; prefix != "" {
+		opts["prefix"] = prefix
+	}
+	return NewProvider(providerURL.Scheme, opts)
+}
+
+// NOTE providers later in the chain take precedence, their keys replace those of the same section before them
+type Chain []Provider
+
+func (c Chain) GetConfig() (string, error) {
+	merged, err := goconfig.LoadFromReader(bytes.NewReader([]byte{}))
+	if err != nil {
+		return "", err
+	}
+	for _, provider := range c {
+		cfg, err := provider.GetConfig()
+		if err != nil {
+			return "", err
+		}
+		gc, err := goconfig.LoadFromReader(bytes.NewReader([]byte(cfg)))
+		if err != nil {
+			return "", err
+		}
+		for _, section := range gc.GetSectionList() {
+			for _, key := range gc.GetKeyList(section) {
+				value, err := gc.GetValue(section, key)
+				if err != nil {
+					return "", err
+				}
+				merged.SetValue(section, key, value)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	err = goconfig.SaveConfigData(merged, &buf)
+	return buf.String(), err
+}
@@ -0,0 +1,51 @@
+package configuration
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rclone/rclone/fs/config"
+)
+
+// NOTE the client is built from the rclone remote config so that it uses the same credentials
+func NewS3Client(remote string) (*s3.S3, error) {
+	remoteType, _ := config.FileGetFlag(remote, "type")
+	if remoteType != "s3" {
+		return nil, fmt.Errorf("remote is not s3: %s", remote)
+	}
+	awsConfig := &aws.Config{}
+	region, _ := config.FileGetFlag(remote, "region")
+	if region != "" {
+		awsConfig.Region = aws.String(region)
+	}
+	endpoint, _ := config.FileGetFlag(remote, "endpoint")
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	accessKeyID, _ := config.FileGetFlag(remote, "access_key_id")
+	secretAccessKey, _ := config.FileGetFlag(remote, "secret_access_key")
+	if accessKeyID != "" && secretAccessKey != "" {
+		sessionToken, _ := config.FileGetFlag(remote, "session_token")
+		awsConfig.Credentials = credentials.NewStaticCredentials(accessKeyID, secretAccessKey, sessionToken)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// NOTE the first element of an s3 remote path is the bucket
+func GetS3Location(objPath string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(objPath), "/"), "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,91 @@
+package configuration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/Unknwon/goconfig"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+)
+
+// NOTE the storage keeps the config in memory so that credentials are never written to disk
+// NOTE it is parsed by the same ini library as the rclone config file so values are read the same way
+// NOTE every configuration is its own storage and the one rclone uses is chosen with Install
+type Storage struct {
+	Config *goconfig.ConfigFile
+}
+
+func NewStorage(cfg string) (*Storage, error) {
+	gc, err := goconfig.LoadFromReader(bytes.NewReader([]byte(cfg)))
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{gc}, nil
+}
+
+// NOTE rclone only replaces its storage when it has a config path, the path is never read or written
+// NOTE remotes cached by rclone were built from the storage being replaced so they are dropped with it
+func (s *Storage) Install() error {
+	if config.GetConfigPath() == "" {
+		err := config.SetConfigPath(filepath.Join(os.TempDir(), "rclone.conf"))
+		if err != nil {
+			return err
+		}
+	}
+	config.SetData(s)
+	cache.Clear()
+	return nil
+}
+
+func (s *Storage) GetSectionList() []string {
+	return s.Config.GetSectionList()
+}
+
+func (s *Storage) HasSection(section string) bool {
+	_, err := s.Config.GetSection(section)
+	return err == nil
+}
+
+func (s *Storage) DeleteSection(section string) {
+	s.Config.DeleteSection(section)
+}
+
+func (s *Storage) GetKeyList(section string) []string {
+	return s.Config.GetKeyList(section)
+}
+
+func (s *Storage) GetValue(section string, key string) (string, bool) {
+	value, err := s.Config.GetValue(section, key)
+	if err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+func (s *Storage) SetValue(section string, key string, value string) {
+	s.Config.SetValue(section, key, value)
+}
+
+func (s *Storage) DeleteKey(section string, key string) bool {
+	return s.Config.DeleteKey(section, key)
+}
+
+// NOTE the config is loaded when the storage is created
+func (s *Storage) Load() error {
+	return nil
+}
+
+// NOTE changes made by backends, eg refreshed tokens, are kept in memory for the life of the process
+func (s *Storage) Save() error {
+	return nil
+}
+
+func (s *Storage) Serialize() (string, error) {
+	var buf bytes.Buffer
+	err := goconfig.SaveConfigData(s.Config, &buf)
+	return buf.String(), err
+}
+
+var _ config.Storage = (*Storage)(nil)
@@ -2,6 +2,7 @@ package enqueuer
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -31,7 +32,10 @@ func (e *AWSEnqueuer) EnqueueJob(job job.Job) error {
 	if err != nil {
 		return err
 	}
-	str, _ := json.Marshal(job)
+	str, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
 	sendMessageInput := &sqs.SendMessageInput{
 		MessageBody: aws.String(string(str)),
 		QueueUrl:    aws.String(*getQueueURLOutput.QueueUrl),
@@ -54,7 +58,10 @@ func (e *AWSEnqueuer) EnqueueTransfer(transferObj transfer.Transfer) error {
 	if err != nil {
 		return err
 	}
-	str, _ := json.Marshal(transferObj)
+	str, err := json.Marshal(transferObj)
+	if err != nil {
+		return err
+	}
 	sendMessageInput := &sqs.SendMessageInput{
 		MessageBody: aws.String(string(str)),
 		QueueUrl:    aws.String(*getQueueURLOutput.QueueUrl),
@@ -65,3 +72,66 @@ func (e *AWSEnqueuer) EnqueueTransfer(transferObj transfer.Transfer) error {
 	}
 	return nil
 }
+
+// NOTE sqs delays a message for at most 15 minutes
+func (e *AWSEnqueuer) DeferTransfer(transferObj transfer.Transfer, delay time.Duration) error {
+	getQueueURLInput := &sqs.GetQueueUrlInput{
+		QueueName: aws.String(e.TransferQueue),
+	}
+	sqsClient := sqs.New(session.New(), &aws.Config{
+		Region: aws.String(e.Region),
+	})
+	getQueueURLOutput, err := sqsClient.GetQueueUrl(getQueueURLInput)
+	if err != nil {
+		return err
+	}
+	if delay > 15*time.Minute {
+		delay = 15 * time.Minute
+	}
+	str, err := json.Marshal(transferObj)
+	if err != nil {
+		return err
+	}
+	sendMessageInput := &sqs.SendMessageInput{
+		MessageBody:  aws.String(string(str)),
+		QueueUrl:     aws.String(*getQueueURLOutput.QueueUrl),
+		DelaySeconds: aws.Int64(int64(delay.Seconds())),
+	}
+	_, err = sqsClient.SendMessage(sendMessageInput)
+	return err
+}
+
+// NOTE the redrive policy of the queue sets how many receives a message gets before it moves to the dead letter queue
+// NOTE zero means the queue has no dead letter queue
+func (e *AWSEnqueuer) GetMaxReceiveCount() (int, error) {
+	getQueueURLInput := &sqs.GetQueueUrlInput{
+		QueueName: aws.String(e.TransferQueue),
+	}
+	sqsClient := sqs.New(session.New(), &aws.Config{
+		Region: aws.String(e.Region),
+	})
+	getQueueURLOutput, err := sqsClient.GetQueueUrl(getQueueURLInput)
+	if err != nil {
+		return 0, err
+	}
+	getQueueAttributesOutput, err := sqsClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       getQueueURLOutput.QueueUrl,
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNameRedrivePolicy}),
+	})
+	if err != nil {
+		return 0, err
+	}
+	redrivePolicy, ok := getQueueAttributesOutput.Attributes[sqs.QueueAttributeNameRedrivePolicy]
+	if !ok {
+		return 0, nil
+	}
+	policy := struct {
+		MaxReceiveCount json.Number `json:"maxReceiveCount"`
+	}{}
+	err = json.Unmarshal([]byte(aws.StringValue(redrivePolicy)), &policy)
+	if err != nil {
+		return 0, err
+	}
+	maxReceiveCount, err := policy.MaxReceiveCount.Int64()
+	return int(maxReceiveCount), err
+}
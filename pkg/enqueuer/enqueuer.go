@@ -1,6 +1,8 @@
 package enqueuer
 
 import (
+	"time"
+
 	"github.com/tinkeractive/transferless/pkg/job"
 	"github.com/tinkeractive/transferless/pkg/transfer"
 )
@@ -8,4 +10,5 @@ import (
 type Enqueuer interface {
 	EnqueueJob(transferJob job.Job) error
 	EnqueueTransfer(transferObj transfer.Transfer) error
+	DeferTransfer(transferObj transfer.Transfer, delay time.Duration) error
 }
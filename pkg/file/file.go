@@ -9,6 +9,7 @@ type File struct {
 	Name         string
 	Size         int64
 	LastModified int64
+	Hash         string `json:",omitempty"`
 }
 
 func (f File) String() string {
@@ -2,40 +2,266 @@ package job
 
 import (
 	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	DateErrorSkip    = "skip"
+	DateErrorFail    = "fail"
+	DateErrorModTime = "modtime"
+)
+
+const (
+	ModeCopy   = "copy"
+	ModeMirror = "mirror"
+)
+
+const (
+	PostActionNone    = "none"
+	PostActionDelete  = "delete"
+	PostActionArchive = "archive"
+	PostActionRename  = "rename"
+	PostActionTag     = "tag"
+)
+
+type JobPostAction struct {
+	Action   string
+	Remote   string            `json:",omitempty"`
+	Root     string            `json:",omitempty"`
+	Pattern  string            `json:",omitempty"`
+	Suffix   string            `json:",omitempty"`
+	Tags     map[string]string `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+}
+
 type JobSource struct {
-	Remote  string
-	Root    string
-	Pattern string
-	Delete  bool `json:",omitempty"`
+	Remote         string
+	Root           string
+	Pattern        string
+	Delete         bool           `json:",omitempty"`
+	Decompress     string         `json:",omitempty"`
+	Extract        string         `json:",omitempty"`
+	MaxEntries     int            `json:",omitempty"`
+	MaxExtractSize int64          `json:",omitempty"`
+	DecryptKeys    []string       `json:",omitempty"`
+	VerifyKeys     []string       `json:",omitempty"`
+	DatePattern    string         `json:",omitempty"`
+	DateLayout     string         `json:",omitempty"`
+	DateFrom       string         `json:",omitempty"`
+	DateTo         string         `json:",omitempty"`
+	OnDateError    string         `json:",omitempty"`
+	PostAction     *JobPostAction `json:",omitempty"`
+}
+
+type JobTransform struct {
+	Type  string
+	From  string `json:",omitempty"`
+	To    string `json:",omitempty"`
+	Lines int    `json:",omitempty"`
+}
+
+type JobSidecar struct {
+	Type    string
+	Hash    string `json:",omitempty"`
+	Pattern string `json:",omitempty"`
+}
+
+type JobManifest struct {
+	Format   string `json:",omitempty"`
+	Pattern  string `json:",omitempty"`
+	Template string `json:",omitempty"`
+	Hash     string `json:",omitempty"`
+}
+
+type JobSplit struct {
+	Size    int64  `json:",omitempty"`
+	Lines   int    `json:",omitempty"`
+	Pattern string `json:",omitempty"`
+}
+
+type JobConcatenate struct {
+	Pattern     string `json:",omitempty"`
+	Header      bool   `json:",omitempty"`
+	HeaderLines int    `json:",omitempty"`
 }
 
 type JobTarget struct {
-	Remote     string
-	Root       string
-	Pattern    string
-	DateFormat string
-	TimeFormat string
+	Remote           string
+	Root             string
+	Pattern          string
+	DateFormat       string
+	TimeFormat       string
+	Verify           bool              `json:",omitempty"`
+	Hashes           []string          `json:",omitempty"`
+	TempPrefix       string            `json:",omitempty"`
+	TempSuffix       string            `json:",omitempty"`
+	Compress         string            `json:",omitempty"`
+	Archive          string            `json:",omitempty"`
+	EncryptKeys      []string          `json:",omitempty"`
+	SignKey          string            `json:",omitempty"`
+	Armor            bool              `json:",omitempty"`
+	OnConflict       string            `json:",omitempty"`
+	Timezone         string            `json:",omitempty"`
+	DateSource       string            `json:",omitempty"`
+	Resumable        bool              `json:",omitempty"`
+	ChunkSize        int64             `json:",omitempty"`
+	PreserveMetadata bool              `json:",omitempty"`
+	Metadata         map[string]string `json:",omitempty"`
+	Tags             map[string]string `json:",omitempty"`
+	StorageClass     string            `json:",omitempty"`
+	Permissions      string            `json:",omitempty"`
+	Owner            string            `json:",omitempty"`
+	Transforms       []JobTransform    `json:",omitempty"`
+	Sidecars         []JobSidecar      `json:",omitempty"`
+	Manifest         *JobManifest      `json:",omitempty"`
+	Split            *JobSplit         `json:",omitempty"`
+	Concatenate      *JobConcatenate   `json:",omitempty"`
+}
+
+type JobRetry struct {
+	MaxAttempts    int    `json:",omitempty"`
+	InitialBackoff string `json:",omitempty"`
+	MaxBackoff     string `json:",omitempty"`
+}
+
+type JobNotification struct {
+	Events   []string
+	Channels []string
 }
 
 type Job struct {
-	Name    string
-	Source  JobSource
-	Targets []JobTarget
+	Name             string
+	Source           JobSource
+	Targets          []JobTarget
+	Concurrency      int `json:",omitempty"`
+	Retry            JobRetry
+	Notifications    []JobNotification `json:",omitempty"`
+	Deadline         string            `json:",omitempty"`
+	Timezone         string            `json:",omitempty"`
+	Mode             string            `json:",omitempty"`
+	MaxDeletePercent int               `json:",omitempty"`
 }
 
 // NOTE ini sections cannot have forward slash in the name
 func (j *Job) Clean() error {
 	var err error
 	j.Source.Remote = strings.ReplaceAll(j.Source.Remote, "/", "")
+	if j.Source.PostAction != nil {
+		j.Source.PostAction.Remote = strings.ReplaceAll(j.Source.PostAction.Remote, "/", "")
+	}
 	for i, target := range j.Targets {
 		j.Targets[i].Remote = strings.ReplaceAll(target.Remote, "/", "")
 	}
 	return err
 }
 
+// NOTE jobs copy new and modified files unless they mirror the source
+func (j Job) GetMode() string {
+	if j.Mode == "" {
+		return ModeCopy
+	}
+	return j.Mode
+}
+
+// NOTE bundled targets receive one transfer for all the files of a compile run
+func (t JobTarget) IsBundled() bool {
+	return t.Archive != "" || t.Concatenate != nil
+}
+
+// NOTE a concatenated target takes the files of the run whose names match its pattern, an archive takes them all
+func (t JobTarget) IsBundleMember(fileName string) (bool, error) {
+	if t.Concatenate == nil || t.Concatenate.Pattern == "" {
+		return true, nil
+	}
+	return regexp.MatchString(t.Concatenate.Pattern, fileName)
+}
+
+// NOTE the delete flag predates post actions and is the same as the delete action
+func (s JobSource) GetPostAction() string {
+	if s.PostAction != nil && s.PostAction.Action != "" {
+		return s.PostAction.Action
+	}
+	if s.Delete {
+		return PostActionDelete
+	}
+	return PostActionNone
+}
+
+// NOTE the date is the named group date, the first group or the whole match of the date pattern in that order
+func (s JobSource) ParseDate(fileName string, loc *time.Location) (time.Time, error) {
+	re, err := regexp.Compile(s.DatePattern)
+	if err != nil {
+		return time.Time{}, err
+	}
+	match := re.FindStringSubmatch(fileName)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("no date in file name: %s", fileName)
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	if index := re.SubexpIndex("date"); index > 0 {
+		value = match[index]
+	}
+	return time.ParseInLocation(s.DateLayout, value, loc)
+}
+
+// NOTE the compiler filters files by the date in their names when a date pattern or a date range is set
+func (s JobSource) IsDateFiltered() bool {
+	return s.DatePattern != "" || s.DateFrom != "" || s.DateTo != ""
+}
+
+// NOTE the date is parsed with the date pattern and layout when they are set
+// NOTE otherwise it is read from the year, month, day, hour, minute and second capture groups of the source pattern
+// NOTE the date is interpreted in the given zone and groups other than year default to the start of the period
+func (s JobSource) GetFileNameDate(fileName string, loc *time.Location) (time.Time, error) {
+	if s.DatePattern != "" {
+		return s.ParseDate(fileName, loc)
+	}
+	captures, err := GetCaptures(s.Pattern, fileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if captures["year"] == "" {
+		return time.Time{}, fmt.Errorf("no year in file name: %s", fileName)
+	}
+	parts := []int{0, 1, 1, 0, 0, 0}
+	for i, key := range []string{"year", "month", "day", "hour", "minute", "second"} {
+		if captures[key] == "" {
+			continue
+		}
+		parts[i], err = strconv.Atoi(captures[key])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid %s in file name: %s", key, fileName)
+		}
+	}
+	return time.Date(parts[0], time.Month(parts[1]), parts[2], parts[3], parts[4], parts[5], 0, loc), nil
+}
+
+// NOTE named capture groups of a pattern by name, empty when the name does not match
+func GetCaptures(pattern, fileName string) (map[string]string, error) {
+	result := map[string]string{}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return result, err
+	}
+	match := re.FindStringSubmatch(fileName)
+	if match == nil {
+		return result, nil
+	}
+	for i, key := range re.SubexpNames() {
+		if key != "" {
+			result[key] = match[i]
+		}
+	}
+	return result, nil
+}
+
 func (j Job) String() string {
 	b, err := json.MarshalIndent(j, " ", "")
 	if err != nil {
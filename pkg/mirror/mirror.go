@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+)
+
+// NOTE an entry records a target object delivered from a source file of a mirrored job
+// NOTE target names are rendered from patterns so the mirror keeps the mapping instead of deriving it
+type Entry struct {
+	Key    string `json:"-"`
+	Source string
+	Path   string
+}
+
+func GetTargetKey(target job.JobTarget) string {
+	sum := sha1.Sum([]byte(target.Remote + ":" + path.Clean(target.Root)))
+	return hex.EncodeToString(sum[:])
+}
+
+func GetSourceKey(sourceName string) string {
+	sum := sha1.Sum([]byte(sourceName))
+	return hex.EncodeToString(sum[:])
+}
+
+func GetKey(jobName string, target job.JobTarget, parts ...string) string {
+	return path.Join(append([]string{"mirror", jobName, GetTargetKey(target)}, parts...)...)
+}
+
+// NOTE a source file can be delivered to several objects of a target so entries are keyed by source and path
+func GetEntryKey(entry Entry) string {
+	sum := sha1.Sum([]byte(entry.Path))
+	return GetSourceKey(entry.Source) + "-" + hex.EncodeToString(sum[:8])
+}
+
+func GetEntrySource(key string) string {
+	return strings.SplitN(key, "-", 2)[0]
+}
+
+func Put(store *state.Store, jobName string, target job.JobTarget, entry Entry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetKey(jobName, target, GetEntryKey(entry)), value)
+}
+
+func Delete(store *state.Store, jobName string, target job.JobTarget, entry Entry) error {
+	return store.Delete(GetKey(jobName, target, entry.Key))
+}
+
+// NOTE the keys name the source file so the compiler can compare them with a listing without reading every entry
+func ListKeys(store *state.Store, jobName string, target job.JobTarget) ([]string, error) {
+	return store.List(GetKey(jobName, target))
+}
+
+func Get(store *state.Store, jobName string, target job.JobTarget, key string) (Entry, error) {
+	result := Entry{Key: key}
+	value, err := store.Get(GetKey(jobName, target, key))
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(value, &result)
+	return result, err
+}
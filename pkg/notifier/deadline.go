@@ -0,0 +1,90 @@
+package notifier
+
+import (
+	"fmt"
+	"path"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+)
+
+const DeadlineLayout = "15:04"
+
+// NOTE days are kept in the timezone of the job so that the deadline and arrivals fall on the same day
+func GetDay(jobObj job.Job, now time.Time) (string, error) {
+	location, err := GetLocation(jobObj)
+	if err != nil {
+		return "", err
+	}
+	return now.In(location).Format("2006-01-02"), nil
+}
+
+func GetLocation(jobObj job.Job) (*time.Location, error) {
+	if jobObj.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(jobObj.Timezone)
+}
+
+// NOTE the deadline is a time of day, eg 06:30, in the timezone of the job
+func GetDeadline(jobObj job.Job, now time.Time) (time.Time, error) {
+	location, err := GetLocation(jobObj)
+	if err != nil {
+		return time.Time{}, err
+	}
+	deadline, err := time.Parse(DeadlineLayout, jobObj.Deadline)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %s: %w", jobObj.Deadline, err)
+	}
+	local := now.In(location)
+	return time.Date(local.Year(), local.Month(), local.Day(), deadline.Hour(), deadline.Minute(), 0, 0, location), nil
+}
+
+func GetArrivalKey(jobName, kind, day string) string {
+	return path.Join("jobs", jobName, kind, day)
+}
+
+// NOTE arrivals are only recorded for jobs with a deadline
+func PutArrival(store *state.Store, jobObj job.Job, now time.Time) error {
+	if jobObj.Deadline == "" {
+		return nil
+	}
+	day, err := GetDay(jobObj, now)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetArrivalKey(jobObj.Name, "arrived", day), []byte{})
+}
+
+// NOTE the compiler checks the deadline on every run while it holds the job lock
+// NOTE nothing arriving is notified once a day and only once the deadline has passed
+func CheckDeadline(store *state.Store, jobObj job.Job, now time.Time) error {
+	if jobObj.Deadline == "" || !IsNotified(jobObj, EventMissing) {
+		return nil
+	}
+	deadline, err := GetDeadline(jobObj, now)
+	if err != nil || now.Before(deadline) {
+		return err
+	}
+	day, err := GetDay(jobObj, now)
+	if err != nil {
+		return err
+	}
+	for _, kind := range []string{"arrived", "missing"} {
+		_, err = store.Get(GetArrivalKey(jobObj.Name, kind, day))
+		if err == nil {
+			return nil
+		}
+		if err != state.ErrNotFound {
+			return err
+		}
+	}
+	err = store.Put(GetArrivalKey(jobObj.Name, "missing", day), []byte{})
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("nothing arrived for %s by %s %s", jobObj.Name, jobObj.Deadline, deadline.Location())
+	return Notify(jobObj, NewEvent(EventMissing, jobObj.Name, message))
+}
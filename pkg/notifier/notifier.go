@@ -0,0 +1,124 @@
+package notifier
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/run"
+)
+
+const (
+	EventRunSucceeded  = "run-succeeded"
+	EventRunFailed     = "run-failed"
+	EventFileDelivered = "file-delivered"
+	EventFileFailed    = "file-failed"
+	EventMissing       = "missing"
+)
+
+type Event struct {
+	Type    string
+	Job     string
+	RunID   string `json:",omitempty"`
+	File    string `json:",omitempty"`
+	Target  string `json:",omitempty"`
+	Message string
+	Time    int64
+	Summary *Summary `json:",omitempty"`
+}
+
+// NOTE the transfer records of a run are left out because a large run would not fit in a message
+// NOTE the path names the object on the data remote that keeps them
+type Summary struct {
+	Status    string
+	Expected  int
+	Finished  int
+	Succeeded int
+	Failed    int
+	Bytes     int64
+	Path      string
+}
+
+func NewSummary(summary run.Summary, summaryPath string) *Summary {
+	return &Summary{
+		Status:    summary.Status,
+		Expected:  summary.Run.Expected,
+		Finished:  summary.Finished,
+		Succeeded: summary.Succeeded,
+		Failed:    summary.Failed,
+		Bytes:     summary.Bytes,
+		Path:      summaryPath,
+	}
+}
+
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// NOTE channels are config sections alongside the rclone remotes and are delivered by the same providers
+// NOTE the type of the section selects the notifier and secrets must be obscured the same way as rclone passwords
+var Notifiers = map[string]func(name string) (Notifier, error){
+	"webhook": NewWebhook,
+	"smtp":    NewSMTP,
+	"sns":     NewSNS,
+}
+
+func New(name string) (Notifier, error) {
+	channelType, _ := config.FileGetFlag(name, "type")
+	newNotifier, ok := Notifiers[channelType]
+	if !ok {
+		return nil, fmt.Errorf("config section is not a notification channel: %s", name)
+	}
+	return newNotifier(name)
+}
+
+func NewEvent(eventType, jobName, message string) Event {
+	return Event{Type: eventType, Job: jobName, Message: message, Time: time.Now().Unix()}
+}
+
+// NOTE every channel of every notification listening for the event is notified
+// NOTE a failed channel does not stop the others and the last error is returned for logging
+func Notify(jobObj job.Job, event Event) error {
+	var result error
+	for _, notification := range jobObj.Notifications {
+		if !Contains(notification.Events, event.Type) {
+			continue
+		}
+		for _, channel := range notification.Channels {
+			log.Println("notifying:", event.Type, channel)
+			notifier, err := New(channel)
+			if err == nil {
+				err = notifier.Notify(event)
+			}
+			if err != nil {
+				log.Println("failed to notify:", channel, err)
+				result = err
+			}
+		}
+	}
+	return result
+}
+
+func IsNotified(jobObj job.Job, eventType string) bool {
+	for _, notification := range jobObj.Notifications {
+		if Contains(notification.Events, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func Contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func GetSubject(event Event) string {
+	return fmt.Sprintf("transferless %s: %s", event.Type, event.Job)
+}
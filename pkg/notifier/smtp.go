@@ -0,0 +1,80 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/obscure"
+)
+
+const DefaultSMTPPort = "587"
+
+type SMTP struct {
+	Host string
+	Port string
+	User string
+	Pass string
+	From string
+	To   []string
+}
+
+// NOTE recipients are a comma separated list and the sender defaults to the user
+func NewSMTP(name string) (Notifier, error) {
+	result := &SMTP{}
+	result.Host, _ = config.FileGetFlag(name, "host")
+	result.Port, _ = config.FileGetFlag(name, "port")
+	result.User, _ = config.FileGetFlag(name, "user")
+	result.From, _ = config.FileGetFlag(name, "from")
+	to, _ := config.FileGetFlag(name, "to")
+	for _, recipient := range strings.Split(to, ",") {
+		if strings.TrimSpace(recipient) != "" {
+			result.To = append(result.To, strings.TrimSpace(recipient))
+		}
+	}
+	if result.Host == "" || len(result.To) == 0 {
+		return nil, fmt.Errorf("smtp channel requires a host and recipients: %s", name)
+	}
+	if result.Port == "" {
+		result.Port = DefaultSMTPPort
+	}
+	if result.From == "" {
+		result.From = result.User
+	}
+	pass, ok := config.FileGetFlag(name, "pass")
+	if ok {
+		var err error
+		result.Pass, err = obscure.Reveal(pass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// NOTE the server must offer tls for authentication, smtp.SendMail upgrades the connection with starttls
+func (s *SMTP) Notify(event Event) error {
+	body, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", GetSubject(event))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\n", event.Message)
+	msg.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+	msg.WriteString("\r\n")
+	var auth smtp.Auth
+	if s.User != "" {
+		auth = smtp.PlainAuth("", s.User, s.Pass, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, s.To, msg.Bytes())
+}
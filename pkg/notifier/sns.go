@@ -0,0 +1,60 @@
+package notifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/rclone/rclone/fs/config"
+)
+
+// NOTE sns limits subjects to 100 characters
+const MaxSubjectLength = 100
+
+type SNS struct {
+	TopicARN string
+	Region   string
+}
+
+// NOTE the region defaults to that of the function
+func NewSNS(name string) (Notifier, error) {
+	topicARN, ok := config.FileGetFlag(name, "topic_arn")
+	if !ok {
+		return nil, fmt.Errorf("sns channel has no topic_arn: %s", name)
+	}
+	region, _ := config.FileGetFlag(name, "region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	return &SNS{topicARN, region}, nil
+}
+
+// NOTE the event type is set as a message attribute so that subscriptions can filter on it
+func (s *SNS) Notify(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	subject := GetSubject(event)
+	if len(subject) > MaxSubjectLength {
+		subject = subject[:MaxSubjectLength]
+	}
+	snsClient := sns.New(session.New(), &aws.Config{
+		Region: aws.String(s.Region),
+	})
+	_, err = snsClient.Publish(&sns.PublishInput{
+		TopicArn: aws.String(s.TopicARN),
+		Subject:  aws.String(subject),
+		Message:  aws.String(string(body)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"event": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(event.Type),
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,80 @@
+package notifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/obscure"
+)
+
+const (
+	EventHeader     = "X-Transferless-Event"
+	TimestampHeader = "X-Transferless-Timestamp"
+	SignatureHeader = "X-Transferless-Signature"
+	WebhookTimeout  = 30 * time.Second
+)
+
+type Webhook struct {
+	URL    string
+	Secret string
+}
+
+func NewWebhook(name string) (Notifier, error) {
+	url, ok := config.FileGetFlag(name, "url")
+	if !ok {
+		return nil, fmt.Errorf("webhook has no url: %s", name)
+	}
+	secret, ok := config.FileGetFlag(name, "secret")
+	if ok {
+		var err error
+		secret, err = obscure.Reveal(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Webhook{url, secret}, nil
+}
+
+// NOTE the signature is the hex hmac sha256 of the timestamp, a dot and the body so that receivers can reject replays
+func (w *Webhook) Notify(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(TimestampHeader, timestamp)
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.Secret, timestamp, body))
+	}
+	client := &http.Client{Timeout: WebhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, w.URL)
+	}
+	return nil
+}
+
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
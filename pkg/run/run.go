@@ -0,0 +1,289 @@
+package run
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/tinkeractive/transferless/pkg/file"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	CompleteTTL     = 15 * time.Minute
+)
+
+// NOTE a run is one compile of a job and the transfers it enqueued, kept in the state store under its id
+// NOTE every writer puts its own object so that concurrent synchronizers update the run atomically
+type Run struct {
+	ID       string
+	Job      job.Job
+	Expected int
+	Bytes    int64
+	Created  int64
+}
+
+// NOTE a transfer record is written once the transfer reaches a final state, succeeded or permanently failed
+type TransferRecord struct {
+	Key      string
+	File     string
+	Sequence int `json:",omitempty"`
+	Size     int64
+	Status   string
+	Error    string `json:",omitempty"`
+	Finished int64
+}
+
+// NOTE the summary of a complete run is its completion event, it is kept with the run and passed to the handler
+type Summary struct {
+	Run       Run
+	Status    string
+	Finished  int
+	Succeeded int
+	Failed    int
+	Bytes     int64
+	Transfers []TransferRecord
+	Completed int64 `json:",omitempty"`
+}
+
+// NOTE rows are only known when the content was streamed through the synchronizer
+type Delivery struct {
+	Target string
+	Path   string
+	Size   int64
+	Hash   string `json:",omitempty"`
+	Rows   *int64 `json:",omitempty"`
+}
+
+// NOTE ids sort by the time of the run and name it for people reading the state store
+func NewRunID(runTime time.Time) (string, error) {
+	byt := make([]byte, 4)
+	_, err := rand.Read(byt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s", runTime.UTC().Format("20060102T150405Z"), hex.EncodeToString(byt)), nil
+}
+
+func GetKey(id string, parts ...string) string {
+	return path.Join(append([]string{"runs", id}, parts...)...)
+}
+
+// NOTE the files of a bundle are kept with the run because a large run does not fit in a queue message
+// NOTE the returned key names them in the bundle transfer
+func PutMembers(store *state.Store, id string, sequence int, files []file.File) (string, error) {
+	key := GetKey(id, "members", fmt.Sprintf("%04d", sequence))
+	value, err := json.Marshal(files)
+	if err != nil {
+		return key, err
+	}
+	return key, store.Put(key, value)
+}
+
+func GetMembers(store *state.Store, key string) ([]file.File, error) {
+	result := []file.File{}
+	value, err := store.Get(key)
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(value, &result)
+	return result, err
+}
+
+// NOTE runs are indexed by job so that the runs of a job can be found by time
+func Create(store *state.Store, runObj Run) error {
+	value, err := json.Marshal(runObj)
+	if err != nil {
+		return err
+	}
+	err = store.Put(GetKey(runObj.ID, "run"), value)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetJobKey(runObj.Job.Name, runObj.ID), []byte{})
+}
+
+func GetJobKey(jobName string, parts ...string) string {
+	return path.Join(append([]string{"jobs", jobName, "runs"}, parts...)...)
+}
+
+// NOTE run ids are returned oldest first
+func List(store *state.Store, jobName string) ([]string, error) {
+	return store.List(GetJobKey(jobName))
+}
+
+func Get(store *state.Store, id string) (Run, error) {
+	result := Run{}
+	value, err := store.Get(GetKey(id, "run"))
+	if err != nil {
+		return result, err
+	}
+	err = json.Unmarshal(value, &result)
+	return result, err
+}
+
+// NOTE a redelivered transfer writes the same key so it is only counted once
+func Finish(store *state.Store, id string, record TransferRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetKey(id, "transfers", record.Key), value)
+}
+
+func ListTransfers(store *state.Store, id string) ([]TransferRecord, error) {
+	keys, err := store.List(GetKey(id, "transfers"))
+	if err != nil {
+		return []TransferRecord{}, err
+	}
+	return GetTransfers(store, id, keys)
+}
+
+func GetTransfers(store *state.Store, id string, keys []string) ([]TransferRecord, error) {
+	result := []TransferRecord{}
+	for _, key := range keys {
+		value, err := store.Get(GetKey(id, "transfers", key))
+		if err != nil {
+			return result, err
+		}
+		record := TransferRecord{}
+		err = json.Unmarshal(value, &record)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+func PutDelivery(store *state.Store, id, key string, delivery Delivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetKey(id, "deliveries", key), value)
+}
+
+func ListDeliveries(store *state.Store, id string) ([]Delivery, error) {
+	result := []Delivery{}
+	keys, err := store.List(GetKey(id, "deliveries"))
+	if err != nil {
+		return result, err
+	}
+	for _, key := range keys {
+		value, err := store.Get(GetKey(id, "deliveries", key))
+		if err != nil {
+			return result, err
+		}
+		delivery := Delivery{}
+		err = json.Unmarshal(value, &delivery)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, delivery)
+	}
+	return result, nil
+}
+
+// NOTE a run is running until as many transfers have finished as it expects and failed if any of them failed
+// NOTE a completed run returns the summary kept when its completion event fired
+// NOTE the records of a running run are only counted, they are read once as many have finished as the run expects
+func GetSummary(store *state.Store, id string) (Summary, error) {
+	result := Summary{}
+	value, err := store.Get(GetKey(id, "completed"))
+	if err == nil {
+		err = json.Unmarshal(value, &result)
+		return result, err
+	}
+	if err != state.ErrNotFound {
+		return result, err
+	}
+	result.Run, err = Get(store, id)
+	if err != nil {
+		return result, err
+	}
+	keys, err := store.List(GetKey(id, "transfers"))
+	if err != nil {
+		return result, err
+	}
+	result.Finished = len(keys)
+	if result.Finished < result.Run.Expected {
+		result.Status = StatusRunning
+		return result, nil
+	}
+	result.Transfers, err = GetTransfers(store, id, keys)
+	if err != nil {
+		return result, err
+	}
+	for _, record := range result.Transfers {
+		if record.Status == StatusSucceeded {
+			result.Succeeded++
+			result.Bytes += record.Size
+		} else {
+			result.Failed++
+		}
+	}
+	result.Status = StatusSucceeded
+	if result.Failed > 0 {
+		result.Status = StatusFailed
+	}
+	return result, nil
+}
+
+// NOTE the run is created after its transfers are enqueued so the compiler checks for completion as well
+// NOTE the completion event fires once for a run, whichever of the compiler or the synchronizers sees it complete first
+// NOTE a failed handler leaves the run incomplete so that the next finished transfer or redelivery fires it again
+func Complete(store *state.Store, id string, handler func(Summary) error) error {
+	summary, err := GetSummary(store, id)
+	if err == state.ErrNotFound {
+		return nil
+	}
+	if err != nil || summary.Status == StatusRunning || summary.Completed != 0 {
+		return err
+	}
+	lockKey := GetKey(id, "complete")
+	claim, ok, err := store.Lock(lockKey, CompleteTTL)
+	if err != nil || !ok {
+		return err
+	}
+	defer store.Unlock(lockKey, claim)
+	_, err = store.Get(GetKey(id, "completed"))
+	if err == nil {
+		return nil
+	}
+	if err != state.ErrNotFound {
+		return err
+	}
+	log.Println("run", summary.Status+":", summary.Run.Job.Name, summary.Run.ID)
+	value, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	err = store.Put(GetKey(id, "summary"), value)
+	if err != nil {
+		return err
+	}
+	err = handler(summary)
+	if err != nil {
+		return err
+	}
+	summary.Completed = time.Now().Unix()
+	value, err = json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return store.Put(GetKey(id, "completed"), value)
+}
+
+// NOTE the summary with its transfer records is written before the handler runs so that notifications can refer to it
+func GetSummaryPath(store *state.Store, id string) string {
+	return fmt.Sprintf("%s:%s", store.Remote, path.Join(store.Root, GetKey(id, "summary")))
+}
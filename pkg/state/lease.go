@@ -0,0 +1,180 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/tinkeractive/transferless/pkg/configuration"
+)
+
+// NOTE backends without conditional writes read the lease back after this delay so that racing writers settle
+const SettleDelay = 2 * time.Second
+
+// NOTE a lease is held by its claim until it expires, an empty lease is a free slot
+type Lease struct {
+	Claim   string
+	Expires int64
+}
+
+func (l Lease) IsExpired() bool {
+	return time.Now().UnixNano() > l.Expires
+}
+
+func GetSlotName(slot int) string {
+	return fmt.Sprintf("slot-%04d", slot)
+}
+
+// NOTE the lease is created when the slot is free and replaced when it has expired, only if nobody else changed it meanwhile
+func (s *Store) TakeLease(key string, lease Lease) (bool, error) {
+	current, version, err := s.GetLease(key)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if err == nil && !current.IsExpired() {
+		return false, nil
+	}
+	if err == nil && current.Claim != "" {
+		log.Println("taking over expired lease:", key)
+	}
+	return s.PutLease(key, lease, version)
+}
+
+func (s *Store) IsS3() bool {
+	remoteType, _ := config.FileGetFlag(s.Remote, "type")
+	return remoteType == "s3"
+}
+
+// NOTE the version is the etag on s3 and a hash of the content elsewhere, empty when there is no lease
+func (s *Store) GetLease(key string) (Lease, string, error) {
+	result := Lease{}
+	var value []byte
+	var version string
+	var err error
+	if s.IsS3() {
+		value, version, err = s.GetS3Object(key)
+	} else {
+		value, err = s.Get(key)
+		sum := sha1.Sum(value)
+		version = hex.EncodeToString(sum[:])
+	}
+	if err != nil {
+		return result, "", err
+	}
+	err = json.Unmarshal(value, &result)
+	return result, version, err
+}
+
+// NOTE s3 puts are conditional on the version so that exactly one writer wins a slot
+// NOTE other backends have no conditional writes so the lease is written, left to settle and read back
+func (s *Store) PutLease(key string, lease Lease, version string) (bool, error) {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	if s.IsS3() {
+		return s.PutS3Object(key, value, version)
+	}
+	current, currentVersion, err := s.GetLease(key)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if currentVersion != version {
+		return false, nil
+	}
+	err = s.Put(key, value)
+	if err != nil {
+		return false, err
+	}
+	if lease.Claim == "" {
+		return true, nil
+	}
+	time.Sleep(SettleDelay)
+	current, _, err = s.GetLease(key)
+	if err != nil {
+		return false, err
+	}
+	return current.Claim == lease.Claim, nil
+}
+
+func (s *Store) GetS3Object(key string) ([]byte, string, error) {
+	client, err := configuration.NewS3Client(s.Remote)
+	if err != nil {
+		return nil, "", err
+	}
+	bucket, objKey := configuration.GetS3Location(path.Join(s.Root, key))
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objKey),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Body.Close()
+	value, err := io.ReadAll(output.Body)
+	return value, aws.StringValue(output.ETag), err
+}
+
+// NOTE an empty version creates the object only if it does not exist, otherwise it is replaced only if unchanged
+// NOTE s3 answers a failed condition with 412 and a concurrent conditional write with 409
+func (s *Store) PutS3Object(key string, value []byte, version string) (bool, error) {
+	client, err := configuration.NewS3Client(s.Remote)
+	if err != nil {
+		return false, err
+	}
+	bucket, objKey := configuration.GetS3Location(path.Join(s.Root, key))
+	req, _ := client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objKey),
+		Body:   bytes.NewReader(value),
+	})
+	if version == "" {
+		req.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		req.HTTPRequest.Header.Set("If-Match", version)
+	}
+	err = req.Send()
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return false, nil
+		}
+	}
+	return err == nil, err
+}
+
+// NOTE live leases are counted so that limits can be shared by the holders of the slots
+func (s *Store) CountLeases(prefix string) (int, error) {
+	result := 0
+	slots, err := s.List(prefix)
+	if err != nil {
+		return result, err
+	}
+	for _, slot := range slots {
+		lease, _, err := s.GetLease(path.Join(prefix, slot))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if lease.Claim != "" && !lease.IsExpired() {
+			result++
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+var ErrNotFound = errors.New("state not found")
+
+// NOTE the store keeps state as objects on the data remote alongside the compiler mutex and mod times
+// NOTE object stores have no compare and swap so shared state is written as one object per writer
+type Store struct {
+	Remote string
+	Root   string
+}
+
+func NewStore(remote, root string) (*Store, error) {
+	if remote == "" {
+		return nil, errors.New("no state remote specified")
+	}
+	return &Store{strings.ReplaceAll(remote, "/", ""), root}, nil
+}
+
+func (s *Store) NewFs(ctx context.Context) (fs.Fs, error) {
+	return fs.NewFs(ctx, fmt.Sprintf("%s:%s", s.Remote, s.Root))
+}
+
+func (s *Store) Get(key string) ([]byte, error) {
+	ctx, err := NewContext()
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := s.NewFs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := fsys.NewObject(ctx, key)
+	if err == fs.ErrorObjectNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	reader, err := obj.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (s *Store) Put(key string, value []byte) error {
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	fsys, err := s.NewFs(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = operations.Rcat(ctx, fsys, key, io.NopCloser(bytes.NewReader(value)), time.Now())
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	fsys, err := s.NewFs(ctx)
+	if err != nil {
+		return err
+	}
+	obj, err := fsys.NewObject(ctx, key)
+	if err == fs.ErrorObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return operations.DeleteFile(ctx, obj)
+}
+
+// NOTE only the objects directly under the prefix are listed and their names are returned in order
+func (s *Store) List(prefix string) ([]string, error) {
+	result := []string{}
+	ctx, err := NewContext()
+	if err != nil {
+		return result, err
+	}
+	fsys, err := s.NewFs(ctx)
+	if err != nil {
+		return result, err
+	}
+	entries, err := fsys.List(ctx, prefix)
+	if err == fs.ErrorDirNotFound {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range entries {
+		if _, ok := entry.(fs.Object); ok {
+			result = append(result, path.Base(entry.Remote()))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// NOTE a lock is a lease on a single slot
+func (s *Store) Lock(key string, ttl time.Duration) (string, bool, error) {
+	return s.Acquire(path.Join("locks", key), 1, ttl)
+}
+
+func (s *Store) Unlock(key, claim string) error {
+	return s.Release(path.Join("locks", key), claim)
+}
+
+// NOTE a claim holds one of the numbered slots under the prefix by taking its lease, see lease.go
+// NOTE the claim names the slot it holds so that it can be released
+func (s *Store) Acquire(prefix string, limit int, ttl time.Duration) (string, bool, error) {
+	id, err := NewClaim()
+	if err != nil {
+		return "", false, err
+	}
+	lease := Lease{Claim: id, Expires: time.Now().Add(ttl).UnixNano()}
+	for slot := 0; slot < limit; slot++ {
+		slotName := GetSlotName(slot)
+		ok, err := s.TakeLease(path.Join(prefix, slotName), lease)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			return path.Join(slotName, id), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// NOTE a lease that was taken over after it expired is left to its new holder
+func (s *Store) Release(prefix, claim string) error {
+	slotName, id := path.Split(claim)
+	key := path.Join(prefix, slotName)
+	current, version, err := s.GetLease(key)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.Claim != id {
+		log.Println("lease already taken over:", key)
+		return nil
+	}
+	_, err = s.PutLease(key, Lease{}, version)
+	return err
+}
+
+// NOTE polls until the lock is acquired or the timeout passes
+func (s *Store) WaitLock(key string, ttl, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		claim, ok, err := s.Lock(key, ttl)
+		if err != nil || ok {
+			return claim, err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for lock: %s", key)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func NewClaim() (string, error) {
+	byt := make([]byte, 8)
+	_, err := rand.Read(byt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(byt)), nil
+}
+
+func NewContext() (context.Context, error) {
+	fi, err := filter.NewFilter(nil)
+	if err != nil {
+		return context.Background(), err
+	}
+	return filter.ReplaceConfig(context.Background(), fi), nil
+}
@@ -0,0 +1,412 @@
+package synchronizer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/tinkeractive/transferless/pkg/file"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	DefaultMaxEntries     = 10000
+	DefaultMaxExtractSize = int64(10 << 30)
+	// NOTE zip archives are read with ranged requests so blocks are cached to avoid one request per read
+	ArchiveBlockSize = int64(1 << 20)
+)
+
+var ArchiveExtensions = map[string]string{
+	"zip":    "zip",
+	"tar":    "tar",
+	"tar.gz": "tar.gz",
+}
+
+var ErrArchiveLimit = errors.New("archive limit exceeded")
+
+var ErrArchiveSource = errors.New("archive cannot be read from a decoded source")
+
+func GetArchiveExtension(format string) (string, error) {
+	ext, ok := ArchiveExtensions[format]
+	if !ok {
+		return "", fmt.Errorf("unknown archive format: %s", format)
+	}
+	return ext, nil
+}
+
+// NOTE the auto format is resolved from the file extension and files without a known extension are copied as is
+func GetExtraction(source job.JobSource, fileName string) string {
+	if source.Extract != "auto" {
+		return source.Extract
+	}
+	switch {
+	case strings.HasSuffix(fileName, ".zip"):
+		return "zip"
+	case strings.HasSuffix(fileName, ".tar.gz"), strings.HasSuffix(fileName, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(fileName, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+func IsExtracted(transferObj transfer.Transfer) bool {
+	return GetExtraction(transferObj.Job.Source, transferObj.File.Name) != ""
+}
+
+// NOTE a source that is decrypted, verified or decompressed is not extracted because entries would be delivered
+// NOTE before a signature is checked at the end of the archive and zip archives are read at random offsets
+func IsDecoded(source job.JobSource, fileName string) bool {
+	return IsDecrypted(source) || GetDecompression(source, fileName) != ""
+}
+
+// NOTE each entry is delivered as a file in the directory of the archive so that the target pattern applies to it
+func Extract(transferObj transfer.Transfer, target job.JobTarget, opts Options) error {
+	if IsDecoded(transferObj.Job.Source, transferObj.File.Name) {
+		return fmt.Errorf("%w: %s", ErrArchiveSource, transferObj.File.Name)
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	ctx = filter.SetUseFilter(ctx, false)
+	sourcePath := GetSourcePath(transferObj)
+	log.Println("extracting source path:", sourcePath)
+	fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+	if err != nil {
+		return err
+	}
+	srcObj, err := fsrc.NewObject(ctx, path.Base(sourcePath))
+	if err != nil {
+		return err
+	}
+	limits := NewArchiveLimits(transferObj.Job.Source)
+	deliver := func(name string, size int64, modTime time.Time, in io.Reader) error {
+		err := limits.AddEntry()
+		if err != nil {
+			return err
+		}
+		entryName, err := CleanEntryName(name)
+		if err != nil {
+			return err
+		}
+		entryTransfer := transferObj
+		entryTransfer.File = file.File{
+			Name:         path.Join(path.Dir(transferObj.File.Name), entryName),
+			Size:         size,
+			LastModified: modTime.Unix(),
+		}
+		log.Println("extracting entry:", entryName)
+		return Deliver(ctx, entryTransfer, target, limits.NewReader(in), modTime, opts)
+	}
+	switch format := GetExtraction(transferObj.Job.Source, transferObj.File.Name); format {
+	case "zip":
+		return ExtractZip(ctx, srcObj, deliver)
+	case "tar", "tar.gz":
+		return ExtractTar(ctx, srcObj, format == "tar.gz", deliver)
+	default:
+		return fmt.Errorf("unknown archive format: %s", format)
+	}
+}
+
+func ExtractZip(ctx context.Context, srcObj fs.Object, deliver func(string, int64, time.Time, io.Reader) error) error {
+	zipReader, err := zip.NewReader(&ObjectReaderAt{Ctx: ctx, Object: srcObj}, srcObj.Size())
+	if err != nil {
+		return err
+	}
+	for _, entry := range zipReader.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		err = deliver(entry.Name, int64(entry.UncompressedSize64), entry.Modified, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ExtractTar(ctx context.Context, srcObj fs.Object, gzipped bool, deliver func(string, int64, time.Time, io.Reader) error) error {
+	srcReader, err := srcObj.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcReader.Close()
+	var in io.Reader = srcReader
+	if gzipped {
+		gzipReader, err := gzip.NewReader(srcReader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		in = gzipReader
+	}
+	tarReader := tar.NewReader(in)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = deliver(header.Name, header.Size, header.ModTime, tarReader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// NOTE entries that would escape the directory of the archive are rejected
+func CleanEntryName(name string) (string, error) {
+	result := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(result) || result == ".." || strings.HasPrefix(result, "../") {
+		return "", fmt.Errorf("invalid archive entry name: %s", name)
+	}
+	return result, nil
+}
+
+// NOTE limits are enforced on the bytes actually read because archive headers can understate sizes
+type ArchiveLimits struct {
+	MaxEntries int
+	MaxSize    int64
+	Entries    int
+	Size       int64
+}
+
+func NewArchiveLimits(source job.JobSource) *ArchiveLimits {
+	limits := ArchiveLimits{source.MaxEntries, source.MaxExtractSize, 0, 0}
+	if limits.MaxEntries <= 0 {
+		limits.MaxEntries = DefaultMaxEntries
+	}
+	if limits.MaxSize <= 0 {
+		limits.MaxSize = DefaultMaxExtractSize
+	}
+	return &limits
+}
+
+func (l *ArchiveLimits) AddEntry() error {
+	l.Entries++
+	if l.Entries > l.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveLimit, l.MaxEntries)
+	}
+	return nil
+}
+
+func (l *ArchiveLimits) NewReader(in io.Reader) io.Reader {
+	return &limitedReader{in, l}
+}
+
+type limitedReader struct {
+	reader io.Reader
+	limits *ArchiveLimits
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.limits.Size += int64(n)
+	if r.limits.Size > r.limits.MaxSize {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrArchiveLimit, r.limits.MaxSize)
+	}
+	return n, err
+}
+
+type ObjectReaderAt struct {
+	Ctx    context.Context
+	Object fs.Object
+	offset int64
+	block  []byte
+}
+
+func (r *ObjectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	result := 0
+	for result < len(p) {
+		if off >= r.Object.Size() {
+			return result, io.EOF
+		}
+		if off < r.offset || off >= r.offset+int64(len(r.block)) {
+			err := r.fill(off)
+			if err != nil {
+				return result, err
+			}
+		}
+		n := copy(p[result:], r.block[off-r.offset:])
+		result += n
+		off += int64(n)
+	}
+	return result, nil
+}
+
+func (r *ObjectReaderAt) fill(off int64) error {
+	end := off + ArchiveBlockSize
+	if end > r.Object.Size() {
+		end = r.Object.Size()
+	}
+	reader, err := r.Object.Open(r.Ctx, &fs.RangeOption{Start: off, End: end - 1})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	block := make([]byte, end-off)
+	_, err = io.ReadFull(reader, block)
+	if err != nil {
+		return err
+	}
+	r.offset = off
+	r.block = block
+	return nil
+}
+
+// NOTE bundle members are read like copied files so that they are decrypted, verified and decompressed
+// NOTE tar needs the size of every member before its content so it cannot pack a decoded source
+// NOTE concatenated members are read like copied files because the result is one stream of their content
+func Pack(transferObj transfer.Transfer, target job.JobTarget, opts Options) error {
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	ctx = filter.SetUseFilter(ctx, false)
+	if target.Concatenate == nil && strings.HasPrefix(target.Archive, "tar") {
+		for _, member := range transferObj.Files {
+			if IsDecoded(transferObj.Job.Source, member.Name) {
+				return fmt.Errorf("%w: %s", ErrArchiveSource, member.Name)
+			}
+		}
+	}
+	var write func(io.Writer) error
+	switch {
+	case target.Concatenate != nil:
+		log.Println("concatenating", len(transferObj.Files), "files")
+		write = func(out io.Writer) error {
+			return Concatenate(ctx, transferObj, target.Concatenate, out)
+		}
+	case target.Archive == "zip":
+		log.Println("packing", len(transferObj.Files), "files as", target.Archive)
+		write = func(out io.Writer) error {
+			return PackZip(ctx, transferObj, out)
+		}
+	case target.Archive == "tar", target.Archive == "tar.gz":
+		log.Println("packing", len(transferObj.Files), "files as", target.Archive)
+		gzipped := target.Archive == "tar.gz"
+		write = func(out io.Writer) error {
+			return PackTar(ctx, transferObj, gzipped, out)
+		}
+	default:
+		return fmt.Errorf("unknown archive format: %s", target.Archive)
+	}
+	reader := Pipe(write)
+	defer reader.Close()
+	return Deliver(ctx, transferObj, target, reader, time.Unix(transferObj.File.LastModified, 0), opts)
+}
+
+func PackZip(ctx context.Context, transferObj transfer.Transfer, out io.Writer) error {
+	zipWriter := zip.NewWriter(out)
+	for _, member := range transferObj.Files {
+		header := &zip.FileHeader{
+			Name:     member.Name,
+			Method:   zip.Deflate,
+			Modified: time.Unix(member.LastModified, 0),
+		}
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		err = CatMember(ctx, transferObj, member, writer)
+		if err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// NOTE the header takes the size of the object when it is opened so that a member changed since listing still packs
+// NOTE and exactly that many bytes are written
+func PackTar(ctx context.Context, transferObj transfer.Transfer, gzipped bool, out io.Writer) error {
+	var gzipWriter *gzip.Writer
+	if gzipped {
+		gzipWriter = gzip.NewWriter(out)
+		out = gzipWriter
+	}
+	tarWriter := tar.NewWriter(out)
+	for _, member := range transferObj.Files {
+		err := func() error {
+			srcObj, reader, err := OpenMember(ctx, transferObj, member)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			header := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     member.Name,
+				Size:     srcObj.Size(),
+				Mode:     0644,
+				ModTime:  srcObj.ModTime(ctx),
+			}
+			err = tarWriter.WriteHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(tarWriter, reader, header.Size)
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	err := tarWriter.Close()
+	if err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		return gzipWriter.Close()
+	}
+	return nil
+}
+
+func CatMember(ctx context.Context, transferObj transfer.Transfer, member file.File, out io.Writer) error {
+	_, reader, err := OpenMember(ctx, transferObj, member)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func OpenMember(ctx context.Context, transferObj transfer.Transfer, member file.File) (fs.Object, io.ReadCloser, error) {
+	memberTransfer := transferObj
+	memberTransfer.File = member
+	sourcePath := GetSourcePath(memberTransfer)
+	fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+	if err != nil {
+		return nil, nil, err
+	}
+	srcObj, err := fsrc.NewObject(ctx, path.Base(sourcePath))
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := NewSourceReader(ctx, memberTransfer, srcObj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcObj, reader, nil
+}
@@ -0,0 +1,101 @@
+package synchronizer
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	dsnetbzip2 "github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tinkeractive/transferless/pkg/job"
+)
+
+var CompressionExtensions = map[string]string{
+	"gzip":  "gz",
+	"zstd":  "zst",
+	"bzip2": "bz2",
+}
+
+func GetCompressionExtension(format string) (string, error) {
+	ext, ok := CompressionExtensions[format]
+	if !ok {
+		return "", fmt.Errorf("unknown compression format: %s", format)
+	}
+	return ext, nil
+}
+
+// NOTE the auto format is resolved from the file extension and files without a known extension are read as is
+func GetDecompression(source job.JobSource, fileName string) string {
+	if source.Decompress != "auto" {
+		return source.Decompress
+	}
+	if IsDecrypted(source) {
+		fileName = TrimEncryptionExtension(fileName)
+	}
+	ext := strings.TrimPrefix(path.Ext(fileName), ".")
+	for format, formatExt := range CompressionExtensions {
+		if ext == formatExt {
+			return format
+		}
+	}
+	return ""
+}
+
+func NewDecompressReader(in io.Reader, format string) (io.ReadCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewReader(in)
+	case "zstd":
+		decoder, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(in)), nil
+	}
+	return nil, fmt.Errorf("unknown compression format: %s", format)
+}
+
+func NewCompressWriter(out io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewWriter(out), nil
+	case "zstd":
+		return zstd.NewWriter(out)
+	case "bzip2":
+		return dsnetbzip2.NewWriter(out, &dsnetbzip2.WriterConfig{Level: dsnetbzip2.DefaultCompression})
+	}
+	return nil, fmt.Errorf("unknown compression format: %s", format)
+}
+
+// NOTE compression runs in a goroutine writing to a pipe so that the data is never staged
+func Compress(in io.Reader, format string) (io.ReadCloser, error) {
+	_, err := GetCompressionExtension(format)
+	if err != nil {
+		return nil, err
+	}
+	return Pipe(func(out io.Writer) error {
+		writer, err := NewCompressWriter(out, format)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, in)
+		if err != nil {
+			return err
+		}
+		return writer.Close()
+	}), nil
+}
+
+// NOTE closing the returned reader unblocks the writer if the consumer stops early
+func Pipe(write func(io.Writer) error) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(write(pipeWriter))
+	}()
+	return pipeReader
+}
@@ -0,0 +1,84 @@
+package synchronizer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+// NOTE members are concatenated in the order they were compiled and decrypted and decompressed like copied files
+// NOTE with header deduplication the header lines are kept from the first member only and every member ends with a newline
+func Concatenate(ctx context.Context, transferObj transfer.Transfer, concatenate *job.JobConcatenate, out io.Writer) error {
+	headerLines := concatenate.HeaderLines
+	if headerLines <= 0 {
+		headerLines = 1
+	}
+	for i, member := range transferObj.Files {
+		err := func() error {
+			memberTransfer := transferObj
+			memberTransfer.File = member
+			sourcePath := GetSourcePath(memberTransfer)
+			fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+			if err != nil {
+				return err
+			}
+			srcObj, err := fsrc.NewObject(ctx, path.Base(sourcePath))
+			if err != nil {
+				return err
+			}
+			reader, err := NewSourceReader(ctx, memberTransfer, srcObj)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+			if !concatenate.Header {
+				_, err = io.Copy(out, reader)
+				return err
+			}
+			var in io.Reader = reader
+			if i > 0 {
+				in = &HeaderStripper{bufio.NewReader(reader), headerLines}
+			}
+			ending := &LineEndingWriter{Writer: out}
+			_, err = io.Copy(ending, in)
+			if err != nil {
+				return err
+			}
+			return ending.Close()
+		}()
+		if err != nil {
+			return fmt.Errorf("concatenating %s: %w", member.Name, err)
+		}
+	}
+	return nil
+}
+
+// NOTE closing adds a newline when the content written does not end with one
+type LineEndingWriter struct {
+	Writer  io.Writer
+	Written bool
+	Last    byte
+}
+
+func (w *LineEndingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.Written = true
+		w.Last = p[n-1]
+	}
+	return n, err
+}
+
+func (w *LineEndingWriter) Close() error {
+	if !w.Written || w.Last == '\n' {
+		return nil
+	}
+	_, err := w.Writer.Write([]byte("\n"))
+	return err
+}
@@ -0,0 +1,147 @@
+package synchronizer
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictFail      = "fail"
+	ConflictSuffix    = "suffix"
+	ConflictTimestamp = "timestamp"
+	// NOTE a lock outliving the longest lambda invocation was abandoned
+	ConflictLockTTL     = 15 * time.Minute
+	ConflictLockTimeout = 5 * time.Minute
+	ConflictTimeFormat  = "20060102T150405Z"
+)
+
+var ErrConflict = errors.New("target already exists")
+
+func IsOverwrite(target job.JobTarget) bool {
+	return target.OnConflict == "" || target.OnConflict == ConflictOverwrite
+}
+
+// NOTE the target path is locked in the state store so that concurrent synchronizers resolve conflicts one at a time
+// NOTE the resolved name is kept under the transfer so that a retry after the object was written reuses it
+// NOTE instead of finding its own object in conflict
+func WithConflictPolicy(ctx context.Context, transferObj transfer.Transfer, store *state.Store, target job.JobTarget, fdst fs.Fs, dstFileName string, write func(string) error) error {
+	if IsOverwrite(target) {
+		return write(dstFileName)
+	}
+	if store == nil {
+		return fmt.Errorf("conflict policy %s requires a state store", target.OnConflict)
+	}
+	key := GetLockKey(target.Remote, path.Join(fdst.Root(), dstFileName))
+	claim, err := store.WaitLock(key, ConflictLockTTL, ConflictLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := store.Unlock(key, claim)
+		if err != nil {
+			log.Println("failed to unlock target:", dstFileName, err)
+		}
+	}()
+	resolvedKey := GetResolvedKey(transferObj, target, path.Join(fdst.Root(), dstFileName))
+	value, err := store.Get(resolvedKey)
+	if err == nil {
+		log.Println("reusing resolved target name:", string(value))
+		return write(string(value))
+	}
+	if err != state.ErrNotFound {
+		return err
+	}
+	resolvedFileName, ok, err := ResolveConflict(ctx, fdst, dstFileName, target.OnConflict)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Println("target exists, skipping:", dstFileName)
+		return nil
+	}
+	err = store.Put(resolvedKey, []byte(resolvedFileName))
+	if err != nil {
+		return err
+	}
+	return write(resolvedFileName)
+}
+
+func GetResolvedKey(transferObj transfer.Transfer, target job.JobTarget, targetPath string) string {
+	sum := sha1.Sum([]byte(targetPath))
+	return path.Join("resolved", GetTransferHash(transferObj), GetTargetHash(target), hex.EncodeToString(sum[:]))
+}
+
+func ResolveConflict(ctx context.Context, fdst fs.Fs, dstFileName, policy string) (string, bool, error) {
+	exists, err := Exists(ctx, fdst, dstFileName)
+	if err != nil || !exists {
+		return dstFileName, err == nil, err
+	}
+	switch policy {
+	case ConflictSkip:
+		return "", false, nil
+	case ConflictFail:
+		return "", false, fmt.Errorf("%w: %s", ErrConflict, path.Join(fdst.Root(), dstFileName))
+	case ConflictSuffix:
+		return GetUniqueName(ctx, fdst, dstFileName)
+	case ConflictTimestamp:
+		stamped := AddSuffix(dstFileName, time.Now().UTC().Format(ConflictTimeFormat))
+		exists, err := Exists(ctx, fdst, stamped)
+		if err != nil || !exists {
+			return stamped, err == nil, err
+		}
+		return GetUniqueName(ctx, fdst, stamped)
+	}
+	return "", false, fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+func GetUniqueName(ctx context.Context, fdst fs.Fs, dstFileName string) (string, bool, error) {
+	for i := 1; ; i++ {
+		candidate := AddSuffix(dstFileName, fmt.Sprint(i))
+		exists, err := Exists(ctx, fdst, candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !exists {
+			return candidate, true, nil
+		}
+	}
+}
+
+// NOTE the suffix goes before the first extension so that eg data.csv.gz becomes data_1.csv.gz
+func AddSuffix(fileName, suffix string) string {
+	index := strings.Index(strings.TrimPrefix(fileName, "."), ".")
+	if index < 0 {
+		return fileName + "_" + suffix
+	}
+	if strings.HasPrefix(fileName, ".") {
+		index++
+	}
+	return fileName[:index] + "_" + suffix + fileName[index:]
+}
+
+func Exists(ctx context.Context, fdst fs.Fs, fileName string) (bool, error) {
+	_, err := fdst.NewObject(ctx, fileName)
+	if err == fs.ErrorObjectNotFound || err == fs.ErrorNotAFile {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func GetLockKey(remote, targetPath string) string {
+	sum := sha1.Sum([]byte(remote + ":" + targetPath))
+	return path.Join("targets", hex.EncodeToString(sum[:]))
+}
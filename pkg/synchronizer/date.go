@@ -0,0 +1,53 @@
+package synchronizer
+
+import (
+	"fmt"
+	"time"
+	// NOTE the zone database is embedded because lambda runtimes do not guarantee one
+	_ "time/tzdata"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	DateSourceModTime  = "modtime"
+	DateSourceCompile  = "compile"
+	DateSourceTransfer = "transfer"
+	DateSourceFileName = "filename"
+)
+
+// NOTE paths are rendered in utc unless the target names a zone so that they do not depend on the host
+func GetLocation(target job.JobTarget) (*time.Location, error) {
+	if target.Timezone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(target.Timezone)
+}
+
+func GetTargetTime(transferObj transfer.Transfer, target job.JobTarget, loc *time.Location) (time.Time, error) {
+	switch target.DateSource {
+	case "":
+		// NOTE files the compiler let through on their mod time fall back to it here as well
+		if transferObj.Job.Source.IsDateFiltered() {
+			datetime, err := GetFileNameTime(transferObj, loc)
+			if err == nil || transferObj.Job.Source.OnDateError != job.DateErrorModTime {
+				return datetime, err
+			}
+		}
+		return time.Unix(transferObj.File.LastModified, 0).In(loc), nil
+	case DateSourceModTime:
+		return time.Unix(transferObj.File.LastModified, 0).In(loc), nil
+	case DateSourceCompile:
+		return time.Unix(transferObj.RunTime, 0).In(loc), nil
+	case DateSourceTransfer:
+		return time.Now().In(loc), nil
+	case DateSourceFileName:
+		return GetFileNameTime(transferObj, loc)
+	}
+	return time.Time{}, fmt.Errorf("unknown date source: %s", target.DateSource)
+}
+
+func GetFileNameTime(transferObj transfer.Transfer, loc *time.Location) (time.Time, error) {
+	return transferObj.Job.Source.GetFileNameDate(transferObj.File.Name, loc)
+}
@@ -0,0 +1,157 @@
+package synchronizer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	DefaultConcurrency = 4
+	ResultSucceeded    = "succeeded"
+)
+
+type TargetResult struct {
+	Index   int
+	Target  job.JobTarget
+	Err     error
+	Skipped bool
+}
+
+type SyncError struct {
+	Results []TargetResult
+}
+
+func (e *SyncError) Error() string {
+	messages := []string{}
+	for _, result := range e.Failed() {
+		messages = append(messages, fmt.Sprintf("target %d %s:%s: %v", result.Index, result.Target.Remote, result.Target.Root, result.Err))
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *SyncError) Failed() []TargetResult {
+	failed := []TargetResult{}
+	for _, result := range e.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+func GetSyncError(results []TargetResult) error {
+	syncErr := &SyncError{results}
+	if len(syncErr.Failed()) == 0 {
+		return nil
+	}
+	return syncErr
+}
+
+// NOTE targets already recorded as delivered for this transfer are skipped so that a retry only reaches the failed ones
+// NOTE results are kept so a redelivered message does not resend, expire them with a lifecycle rule on the data remote
+func FanOut(transferObj transfer.Transfer, indices []int, opts Options, deliver func(job.JobTarget) error) []TargetResult {
+	results := make([]TargetResult, len(indices))
+	concurrency := transferObj.Job.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	semaphore := make(chan struct{}, concurrency)
+	var waitGroup sync.WaitGroup
+	for i, index := range indices {
+		waitGroup.Add(1)
+		go func(i, index int) {
+			defer waitGroup.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			results[i] = DeliverTarget(transferObj, index, opts, deliver)
+		}(i, index)
+	}
+	waitGroup.Wait()
+	return results
+}
+
+func DeliverTarget(transferObj transfer.Transfer, index int, opts Options, deliver func(job.JobTarget) error) TargetResult {
+	target := transferObj.Job.Targets[index]
+	result := TargetResult{Index: index, Target: target}
+	key := GetResultKey(transferObj, target)
+	delivered, err := IsDelivered(opts.Store, key)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if delivered {
+		log.Println("already delivered to target:", index, target.Remote)
+		result.Skipped = true
+		return result
+	}
+	release, err := AcquireSlots(opts.Store, []string{transferObj.Job.Source.Remote, target.Remote})
+	if err != nil {
+		log.Println("deferring target:", index, target.Remote, err)
+		result.Err = err
+		return result
+	}
+	result.Err = WithRetry(transferObj.Job.Retry, func() error {
+		return deliver(target)
+	})
+	err = release()
+	if err != nil {
+		log.Println("failed to release transfer slots:", err)
+	}
+	if result.Err != nil {
+		log.Println("failed to deliver to target:", index, target.Remote, result.Err)
+	}
+	err = PutResult(opts.Store, key, result.Err)
+	if err != nil && result.Err == nil {
+		result.Err = err
+	}
+	return result
+}
+
+func GetResultKey(transferObj transfer.Transfer, target job.JobTarget) string {
+	return path.Join("results", GetTransferHash(transferObj), GetTargetHash(target))
+}
+
+// NOTE a transfer is identified by its job, files and compile run so that a redelivered message maps to the same state
+func GetTransferHash(transferObj transfer.Transfer) string {
+	transferBytes, _ := json.Marshal([]interface{}{transferObj.Job.Name, transferObj.File, transferObj.Files, transferObj.RunTime})
+	transferSum := sha1.Sum(transferBytes)
+	return hex.EncodeToString(transferSum[:])
+}
+
+func GetTargetHash(target job.JobTarget) string {
+	targetBytes, _ := json.Marshal(target)
+	targetSum := sha1.Sum(targetBytes)
+	return hex.EncodeToString(targetSum[:])
+}
+
+func IsDelivered(store *state.Store, key string) (bool, error) {
+	if store == nil {
+		return false, nil
+	}
+	value, err := store.Get(key)
+	if err == state.ErrNotFound {
+		return false, nil
+	}
+	return string(value) == ResultSucceeded, err
+}
+
+func PutResult(store *state.Store, key string, deliverErr error) error {
+	if store == nil {
+		return nil
+	}
+	value := ResultSucceeded
+	if deliverErr != nil {
+		value = deliverErr.Error()
+	}
+	return store.Put(key, []byte(value))
+}
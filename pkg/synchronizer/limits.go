@@ -0,0 +1,242 @@
+package synchronizer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+	"golang.org/x/time/rate"
+)
+
+// NOTE limits are read from the remote sections of the rclone config alongside the backend settings
+const (
+	BwLimitKey      = "transferless_bwlimit"
+	MaxTransfersKey = "transferless_max_transfers"
+	// NOTE slots expire after the longest possible invocation so that a crashed synchronizer frees its slot
+	SlotTTL = 15 * time.Minute
+	// NOTE the smallest read that waits on the limiter
+	MinBurst = 64 * 1024
+	// NOTE how often a limited transfer takes its share of the bandwidth again
+	LimitRefresh = 30 * time.Second
+	// NOTE deferred transfers wait between one and two delays so that they do not return together
+	DeferDelay = time.Minute
+)
+
+var ErrDeferred = errors.New("remote transfer limit reached, deferring")
+
+type RemoteLimits struct {
+	BwLimit      fs.BwTimetable
+	MaxTransfers int
+}
+
+func GetRemoteLimits(remote string) (RemoteLimits, error) {
+	result := RemoteLimits{}
+	bwLimit, _ := config.FileGetFlag(remote, BwLimitKey)
+	if bwLimit != "" {
+		err := result.BwLimit.Set(bwLimit)
+		if err != nil {
+			return result, err
+		}
+	}
+	maxTransfers, _ := config.FileGetFlag(remote, MaxTransfersKey)
+	if maxTransfers != "" {
+		var err error
+		result.MaxTransfers, err = strconv.Atoi(maxTransfers)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// NOTE the bandwidth limit is shared by the transfers that hold a slot of the remote so that together they stay within it
+// NOTE without a transfer cap the limit applies to each transfer, as rclone applies it to each process
+func (l RemoteLimits) GetRate(upload bool, transfers int) int64 {
+	bandwidth := l.BwLimit.LimitAt(time.Now()).Bandwidth
+	result := int64(bandwidth.Rx)
+	if upload {
+		result = int64(bandwidth.Tx)
+	}
+	if result <= 0 {
+		return 0
+	}
+	if l.MaxTransfers > 0 && transfers > 1 {
+		result /= int64(transfers)
+	}
+	return result
+}
+
+func (l RemoteLimits) IsLimited() bool {
+	return l.GetRate(true, 1) > 0 || l.GetRate(false, 1) > 0
+}
+
+// NOTE the live slots are counted from the state store, a count that cannot be read assumes every slot is held
+func (l RemoteLimits) GetTransfers(store *state.Store, remote string) int {
+	if l.MaxTransfers <= 0 {
+		return 1
+	}
+	if store == nil {
+		return l.MaxTransfers
+	}
+	count, err := store.CountLeases(GetSlotPrefix(remote))
+	if err != nil {
+		log.Println("failed to count transfer slots:", remote, err)
+		return l.MaxTransfers
+	}
+	if count < 1 {
+		return 1
+	}
+	return count
+}
+
+// NOTE slots are taken for the source and target remotes in order and released if any remote is full
+// NOTE a transfer that cannot take a slot is deferred rather than waiting inside the invocation
+func AcquireSlots(store *state.Store, remotes []string) (func() error, error) {
+	held := map[string]string{}
+	release := func() error {
+		var result error
+		for remote, claim := range held {
+			err := store.Release(GetSlotPrefix(remote), claim)
+			if err != nil && result == nil {
+				result = err
+			}
+		}
+		return result
+	}
+	sorted := append([]string{}, remotes...)
+	sort.Strings(sorted)
+	for _, remote := range sorted {
+		if _, ok := held[remote]; ok {
+			continue
+		}
+		limits, err := GetRemoteLimits(remote)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if limits.MaxTransfers <= 0 {
+			continue
+		}
+		if store == nil {
+			release()
+			return nil, errors.New("no state store for transfer limit: " + remote)
+		}
+		claim, ok, err := store.Acquire(GetSlotPrefix(remote), limits.MaxTransfers, SlotTTL)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		if !ok {
+			log.Println("no transfer slot available:", remote)
+			release()
+			return nil, ErrDeferred
+		}
+		held[remote] = claim
+	}
+	return release, nil
+}
+
+func GetDeferDelay() time.Duration {
+	return DeferDelay + time.Duration(rand.Int63n(int64(DeferDelay)))
+}
+
+func GetSlotPrefix(remote string) string {
+	return path.Join("slots", remote)
+}
+
+// NOTE limited remotes are streamed so that the content passes through the limiter
+func IsBandwidthLimited(transferObj transfer.Transfer, target job.JobTarget) bool {
+	for _, remote := range []string{transferObj.Job.Source.Remote, target.Remote} {
+		limits, err := GetRemoteLimits(remote)
+		if err == nil && limits.IsLimited() {
+			return true
+		}
+	}
+	return false
+}
+
+// NOTE the delivered content is limited to the lower of the source download and target upload rates
+// NOTE the rate is taken again from the timetable and the live slots every refresh interval while the content is read
+func NewLimitedReader(ctx context.Context, in io.Reader, transferObj transfer.Transfer, target job.JobTarget, opts Options) (io.Reader, error) {
+	sourceLimits, err := GetRemoteLimits(transferObj.Job.Source.Remote)
+	if err != nil {
+		return nil, err
+	}
+	targetLimits, err := GetRemoteLimits(target.Remote)
+	if err != nil {
+		return nil, err
+	}
+	getRate := func() int64 {
+		bytesPerSecond := sourceLimits.GetRate(false, sourceLimits.GetTransfers(opts.Store, transferObj.Job.Source.Remote))
+		targetRate := targetLimits.GetRate(true, targetLimits.GetTransfers(opts.Store, target.Remote))
+		if bytesPerSecond <= 0 || (targetRate > 0 && targetRate < bytesPerSecond) {
+			bytesPerSecond = targetRate
+		}
+		return bytesPerSecond
+	}
+	bytesPerSecond := getRate()
+	if bytesPerSecond <= 0 {
+		return in, nil
+	}
+	log.Println("limiting bandwidth to", fs.SizeSuffix(bytesPerSecond), "per second")
+	return &LimitedReader{in, rate.NewLimiter(rate.Limit(bytesPerSecond), GetBurst(bytesPerSecond)), ctx, getRate, time.Now()}, nil
+}
+
+func GetBurst(bytesPerSecond int64) int {
+	if bytesPerSecond < MinBurst {
+		return MinBurst
+	}
+	return int(bytesPerSecond)
+}
+
+type LimitedReader struct {
+	Reader    io.Reader
+	Limiter   *rate.Limiter
+	Context   context.Context
+	GetRate   func() int64
+	Refreshed time.Time
+}
+
+func (r *LimitedReader) Read(p []byte) (int, error) {
+	r.refresh()
+	if len(p) > r.Limiter.Burst() {
+		p = p[:r.Limiter.Burst()]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		waitErr := r.Limiter.WaitN(r.Context, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// NOTE a rate of zero means the timetable lifted the limit so the limiter stops waiting
+func (r *LimitedReader) refresh() {
+	if time.Since(r.Refreshed) < LimitRefresh {
+		return
+	}
+	r.Refreshed = time.Now()
+	bytesPerSecond := r.GetRate()
+	if bytesPerSecond <= 0 {
+		r.Limiter.SetLimit(rate.Inf)
+		return
+	}
+	if rate.Limit(bytesPerSecond) != r.Limiter.Limit() {
+		log.Println("limiting bandwidth to", fs.SizeSuffix(bytesPerSecond), "per second")
+		r.Limiter.SetBurst(GetBurst(bytesPerSecond))
+		r.Limiter.SetLimit(rate.Limit(bytesPerSecond))
+	}
+}
@@ -0,0 +1,207 @@
+package synchronizer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/run"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	ManifestJSON           = "json"
+	ManifestCSV            = "csv"
+	DefaultManifestHash    = "md5"
+	DefaultManifestPattern = "manifest-{{.RunID}}.{{.Format}}"
+)
+
+type Manifest struct {
+	RunID   string
+	Job     string
+	Created string
+	Files   []run.Delivery
+}
+
+func GetManifestHash(manifest *job.JobManifest) (hash.Type, error) {
+	var result hash.Type
+	name := manifest.Hash
+	if name == "" {
+		name = DefaultManifestHash
+	}
+	err := result.Set(name)
+	return result, err
+}
+
+// NOTE deliveries are recorded for targets with a manifest so that it can list them once the run is complete
+// NOTE the checksum is taken from the stream when it was hashed and otherwise from the backend when it has one
+func RecordDelivery(transferObj transfer.Transfer, target job.JobTarget, opts Options, fdst fs.Fs, dstFileName string, result StreamResult) error {
+	if target.Manifest == nil || transferObj.RunID == "" || opts.Store == nil {
+		return nil
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	dstObj, err := fdst.NewObject(ctx, dstFileName)
+	if err != nil {
+		return err
+	}
+	hashType, err := GetManifestHash(target.Manifest)
+	if err != nil {
+		return err
+	}
+	sum := result.Sums[hashType]
+	if sum == "" && fdst.Hashes().Contains(hashType) {
+		sum, err = dstObj.Hash(ctx, hashType)
+		if err != nil {
+			return err
+		}
+	}
+	fullPath := path.Join(fdst.Root(), dstFileName)
+	delivery := run.Delivery{
+		Target: GetTargetHash(target),
+		Path:   strings.TrimPrefix(strings.TrimPrefix(fullPath, strings.Trim(target.Root, "/")), "/"),
+		Size:   dstObj.Size(),
+		Hash:   sum,
+	}
+	if result.Rows >= 0 {
+		rows := result.Rows
+		delivery.Rows = &rows
+	}
+	keySum := sha1.Sum([]byte(delivery.Target + fullPath))
+	return run.PutDelivery(opts.Store, transferObj.RunID, hex.EncodeToString(keySum[:]), delivery)
+}
+
+// NOTE each target with a manifest receives one listing the files delivered to it in the run
+func WriteManifests(store *state.Store, runObj run.Run) error {
+	deliveries, err := run.ListDeliveries(store, runObj.ID)
+	if err != nil {
+		return err
+	}
+	for _, target := range runObj.Job.Targets {
+		if target.Manifest == nil {
+			continue
+		}
+		targetHash := GetTargetHash(target)
+		manifest := Manifest{
+			RunID:   runObj.ID,
+			Job:     runObj.Job.Name,
+			Created: time.Unix(runObj.Created, 0).UTC().Format(time.RFC3339),
+			Files:   []run.Delivery{},
+		}
+		for _, delivery := range deliveries {
+			if delivery.Target == targetHash {
+				manifest.Files = append(manifest.Files, delivery)
+			}
+		}
+		sort.Slice(manifest.Files, func(i, j int) bool {
+			return manifest.Files[i].Path < manifest.Files[j].Path
+		})
+		err = WriteManifest(target, manifest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteManifest(target job.JobTarget, manifest Manifest) error {
+	content, err := RenderManifest(target.Manifest, manifest)
+	if err != nil {
+		return err
+	}
+	manifestName, err := GetManifestName(target.Manifest, manifest)
+	if err != nil {
+		return err
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", GetTargetRemote(target), target.Root))
+	if err != nil {
+		return err
+	}
+	log.Println("writing manifest:", target.Remote, manifestName)
+	_, err = operations.Rcat(ctx, fdst, manifestName, io.NopCloser(bytes.NewReader(content)), time.Now())
+	return err
+}
+
+func GetManifestFormat(manifestOpts *job.JobManifest) string {
+	if manifestOpts.Format == "" {
+		return ManifestJSON
+	}
+	return strings.ToLower(manifestOpts.Format)
+}
+
+// NOTE the name is rendered with the run id, job and format and is relative to the target root
+func GetManifestName(manifestOpts *job.JobManifest, manifest Manifest) (string, error) {
+	pattern := manifestOpts.Pattern
+	if pattern == "" {
+		pattern = DefaultManifestPattern
+	}
+	tmpl, err := template.New("manifest").Funcs(PatternFuncs).Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"RunID":  manifest.RunID,
+		"Job":    manifest.Job,
+		"Format": GetManifestFormat(manifestOpts),
+	})
+	return path.Clean(buf.String()), err
+}
+
+// NOTE a template replaces the built in formats and is executed with the manifest
+func RenderManifest(manifestOpts *job.JobManifest, manifest Manifest) ([]byte, error) {
+	var buf bytes.Buffer
+	if manifestOpts.Template != "" {
+		tmpl, err := template.New("manifest").Funcs(PatternFuncs).Parse(manifestOpts.Template)
+		if err != nil {
+			return nil, err
+		}
+		err = tmpl.Execute(&buf, manifest)
+		return buf.Bytes(), err
+	}
+	switch GetManifestFormat(manifestOpts) {
+	case ManifestJSON:
+		return json.MarshalIndent(manifest, "", "  ")
+	case ManifestCSV:
+		csvWriter := csv.NewWriter(&buf)
+		err := csvWriter.Write([]string{"path", "size", "hash", "rows"})
+		if err != nil {
+			return nil, err
+		}
+		for _, delivery := range manifest.Files {
+			rows := ""
+			if delivery.Rows != nil {
+				rows = strconv.FormatInt(*delivery.Rows, 10)
+			}
+			err = csvWriter.Write([]string{delivery.Path, strconv.FormatInt(delivery.Size, 10), delivery.Hash, rows})
+			if err != nil {
+				return nil, err
+			}
+		}
+		csvWriter.Flush()
+		return buf.Bytes(), csvWriter.Error()
+	}
+	return nil, fmt.Errorf("unknown manifest format: %s", manifestOpts.Format)
+}
@@ -0,0 +1,175 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	ContentTypeHeader = "Content-Type"
+	TaggingHeader     = "X-Amz-Tagging"
+	MetadataPrefix    = "X-Amz-Meta-"
+)
+
+// NOTE rclone keeps its own metadata for mod times and hashes so it is not copied from the source
+var ReservedMetadata = map[string]bool{
+	"mtime":     true,
+	"md5chksum": true,
+}
+
+type TargetMetadata struct {
+	ContentType string
+	Metadata    map[string]string
+	Tags        map[string]string
+}
+
+func HasAttributes(target job.JobTarget) bool {
+	return target.PreserveMetadata || len(target.Metadata) > 0 || len(target.Tags) > 0 || target.StorageClass != "" || target.Permissions != "" || target.Owner != ""
+}
+
+// NOTE the storage class is set as a connection string override of the remote config
+// NOTE the override gives the target its own config so server-side copies from the same remote are not used
+func GetTargetRemote(target job.JobTarget) string {
+	if target.StorageClass == "" {
+		return target.Remote
+	}
+	return fmt.Sprintf("%s,storage_class=%s", target.Remote, target.StorageClass)
+}
+
+// NOTE the mod time is always carried over, preserving also copies the content type, metadata and tags of the source
+// NOTE the content type is only kept when the content is delivered unchanged
+// NOTE templated values are rendered like target patterns and take precedence over preserved ones
+// NOTE preserved metadata and tags are skipped for targets other than s3, configured ones still fail there
+func GetTargetMetadata(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, srcObj fs.Object) (TargetMetadata, error) {
+	result := TargetMetadata{"", map[string]string{}, map[string]string{}}
+	if target.PreserveMetadata && srcObj != nil {
+		if !IsTransformed(transferObj, target) {
+			result.ContentType = fs.MimeType(ctx, srcObj)
+		}
+		remoteType, _ := config.FileGetFlag(transferObj.Job.Source.Remote, "type")
+		targetType, _ := config.FileGetFlag(target.Remote, "type")
+		if remoteType == "s3" && targetType != "s3" {
+			log.Println("not preserving s3 metadata and tags on target:", target.Remote)
+		} else if remoteType == "s3" {
+			sourcePath := GetSourcePath(transferObj)
+			metadata, err := GetS3Metadata(transferObj.Job.Source.Remote, sourcePath)
+			if err != nil {
+				return result, err
+			}
+			for key, value := range metadata {
+				if !ReservedMetadata[strings.ToLower(key)] {
+					result.Metadata[strings.ToLower(key)] = value
+				}
+			}
+			result.Tags, err = GetS3Tags(transferObj.Job.Source.Remote, sourcePath)
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+	metadata, err := RenderValues(transferObj, target.Metadata)
+	if err != nil {
+		return result, err
+	}
+	for key, value := range metadata {
+		result.Metadata[strings.ToLower(key)] = value
+	}
+	tags, err := RenderValues(transferObj, target.Tags)
+	if err != nil {
+		return result, err
+	}
+	for key, value := range tags {
+		result.Tags[key] = value
+	}
+	return result, nil
+}
+
+// NOTE metadata and tags are only understood by s3 so configuring them on other backends is an error
+func (m TargetMetadata) GetHeaders(target job.JobTarget) ([]*fs.HTTPOption, error) {
+	result := []*fs.HTTPOption{}
+	if m.ContentType != "" {
+		result = append(result, &fs.HTTPOption{Key: ContentTypeHeader, Value: m.ContentType})
+	}
+	if len(m.Metadata) == 0 && len(m.Tags) == 0 {
+		return result, nil
+	}
+	remoteType, _ := config.FileGetFlag(target.Remote, "type")
+	if remoteType != "s3" {
+		return result, fmt.Errorf("metadata and tags are only supported on s3 targets: %s", target.Remote)
+	}
+	for _, key := range SortedKeys(m.Metadata) {
+		result = append(result, &fs.HTTPOption{Key: MetadataPrefix + key, Value: m.Metadata[key]})
+	}
+	if len(m.Tags) > 0 {
+		result = append(result, &fs.HTTPOption{Key: TaggingHeader, Value: EncodeTags(m.Tags)})
+	}
+	return result, nil
+}
+
+// NOTE the headers are added to every upload made with the returned context
+func WithTargetMetadata(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, srcObj fs.Object) (context.Context, TargetMetadata, error) {
+	metadata, err := GetTargetMetadata(ctx, transferObj, target, srcObj)
+	if err != nil {
+		return ctx, metadata, err
+	}
+	headers, err := metadata.GetHeaders(target)
+	if err != nil || len(headers) == 0 {
+		return ctx, metadata, err
+	}
+	ctx, ci := fs.AddConfig(ctx)
+	ci.UploadHeaders = append(ci.UploadHeaders, headers...)
+	return ctx, metadata, nil
+}
+
+// NOTE server-side copies keep the metadata of the source object so templated values are applied afterwards
+func ApplyTargetMetadata(target job.JobTarget, fdst fs.Fs, dstFileName string, metadata TargetMetadata) error {
+	objPath := path.Join(fdst.Root(), dstFileName)
+	if len(metadata.Tags) > 0 {
+		log.Println("tagging target:", objPath)
+		err := AddS3Tags(target.Remote, objPath, metadata.Tags)
+		if err != nil {
+			return err
+		}
+	}
+	if len(metadata.Metadata) > 0 {
+		log.Println("setting target metadata:", objPath)
+		return PutS3Metadata(target.Remote, objPath, metadata.Metadata)
+	}
+	return nil
+}
+
+func EncodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// NOTE multipart uploads are made with the s3 api so the upload headers are copied onto the request
+func SetUploadHeaders(ctx context.Context, input *s3.CreateMultipartUploadInput) {
+	for _, option := range fs.GetConfig(ctx).UploadHeaders {
+		switch {
+		case strings.EqualFold(option.Key, ContentTypeHeader):
+			input.ContentType = aws.String(option.Value)
+		case strings.EqualFold(option.Key, TaggingHeader):
+			input.Tagging = aws.String(option.Value)
+		case strings.HasPrefix(strings.ToLower(option.Key), strings.ToLower(MetadataPrefix)):
+			if input.Metadata == nil {
+				input.Metadata = map[string]*string{}
+			}
+			input.Metadata[strings.ToLower(option.Key[len(MetadataPrefix):])] = aws.String(option.Value)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package synchronizer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/mirror"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+// NOTE bundles are not mirrored because their objects do not belong to a single source file
+func IsMirrored(transferObj transfer.Transfer) bool {
+	return transferObj.Job.GetMode() == job.ModeMirror && transferObj.Operation == "" && len(transferObj.Files) == 0
+}
+
+// NOTE the delivered objects are recorded so that they can be deleted once their source is gone
+// NOTE objects recorded by an earlier delivery of the source under another path are deleted with their entries
+func RecordMirror(transferObj transfer.Transfer, target job.JobTarget, opts Options, fdst fs.Fs, dstFileNames ...string) error {
+	if !IsMirrored(transferObj) {
+		return nil
+	}
+	if opts.Store == nil {
+		return errors.New("mirror requires a state store")
+	}
+	recorded := map[string]bool{}
+	for _, dstFileName := range dstFileNames {
+		entry := mirror.Entry{
+			Source: transferObj.File.Name,
+			Path:   path.Join(fdst.Root(), dstFileName),
+		}
+		err := mirror.Put(opts.Store, transferObj.Job.Name, target, entry)
+		if err != nil {
+			return err
+		}
+		recorded[mirror.GetEntryKey(entry)] = true
+	}
+	stale := []string{}
+	for _, key := range transferObj.Entries[mirror.GetTargetKey(target)] {
+		if !recorded[key] {
+			stale = append(stale, key)
+		}
+	}
+	return DeleteEntries(transferObj, target, opts, stale)
+}
+
+// NOTE every object recorded for the source file is deleted with its sidecars and then forgotten
+// NOTE the entries were named by the compiler so the mirror is not listed for each deletion
+func DeleteMirrored(transferObj transfer.Transfer, target job.JobTarget, opts Options) error {
+	if opts.Store == nil {
+		return errors.New("mirror requires a state store")
+	}
+	return DeleteEntries(transferObj, target, opts, transferObj.Entries[mirror.GetTargetKey(target)])
+}
+
+// NOTE entries and objects already gone are skipped so that a redelivered transfer succeeds
+func DeleteEntries(transferObj transfer.Transfer, target job.JobTarget, opts Options, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		entry, err := mirror.Get(opts.Store, transferObj.Job.Name, target, key)
+		if err == state.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = DeleteTargetPath(ctx, target, entry.Path)
+		if err != nil {
+			return err
+		}
+		err = mirror.Delete(opts.Store, transferObj.Job.Name, target, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NOTE the object at the target path is deleted with its sidecars and objects already gone are skipped
+func DeleteTargetPath(ctx context.Context, target job.JobTarget, targetPath string) error {
+	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", target.Remote, path.Dir(targetPath)))
+	if err != nil {
+		return err
+	}
+	dstFileName := path.Base(targetPath)
+	names := []string{dstFileName}
+	for _, sidecar := range target.Sidecars {
+		sidecarName, err := GetSidecarName(dstFileName, sidecar)
+		if err != nil {
+			return err
+		}
+		names = append(names, sidecarName)
+	}
+	for _, name := range names {
+		dstObj, err := fdst.NewObject(ctx, name)
+		if err == fs.ErrorObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Println("deleting target path:", path.Join(path.Dir(targetPath), name))
+		err = operations.DeleteFile(ctx, dstObj)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
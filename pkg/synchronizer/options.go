@@ -0,0 +1,14 @@
+package synchronizer
+
+import (
+	"time"
+
+	"github.com/tinkeractive/transferless/pkg/state"
+)
+
+// NOTE options carry the settings of an invocation from the command into the synchronizer
+// NOTE the store is optional and only required by targets that coordinate through it
+type Options struct {
+	Store    *state.Store
+	Deadline time.Time
+}
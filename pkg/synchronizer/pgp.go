@@ -0,0 +1,156 @@
+package synchronizer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/tinkeractive/transferless/pkg/configuration"
+	"github.com/tinkeractive/transferless/pkg/job"
+)
+
+const ArmorHeader = "-----BEGIN"
+
+var EncryptionExtensions = []string{"pgp", "gpg", "asc"}
+
+var ErrSignature = errors.New("pgp signature verification failed")
+
+const DefaultTempSuffix = ".partial"
+
+func IsDecrypted(source job.JobSource) bool {
+	return len(source.DecryptKeys) > 0 || len(source.VerifyKeys) > 0
+}
+
+func IsEncrypted(target job.JobTarget) bool {
+	return len(target.EncryptKeys) > 0
+}
+
+func GetEncryptionExtension(target job.JobTarget) string {
+	if target.Armor {
+		return "asc"
+	}
+	return "pgp"
+}
+
+func TrimEncryptionExtension(fileName string) string {
+	ext := strings.TrimPrefix(path.Ext(fileName), ".")
+	for _, encryptionExt := range EncryptionExtensions {
+		if ext == encryptionExt {
+			return strings.TrimSuffix(fileName, "."+ext)
+		}
+	}
+	return fileName
+}
+
+// NOTE signatures can only be checked at the end of the message so the error is returned in place of EOF
+// NOTE the failed read aborts the upload to its temp name which keeps the unverified content from being published
+func Decrypt(in io.Reader, source job.JobSource) (io.Reader, error) {
+	keyRing, err := configuration.GetKeyRing(append(append([]string{}, source.DecryptKeys...), source.VerifyKeys...))
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(in)
+	in = buffered
+	header, _ := buffered.Peek(len(ArmorHeader))
+	if string(header) == ArmorHeader {
+		block, err := armor.Decode(buffered)
+		if err != nil {
+			return nil, err
+		}
+		in = block.Body
+	}
+	md, err := openpgp.ReadMessage(in, keyRing, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyingReader{md, len(source.VerifyKeys) > 0, nil}, nil
+}
+
+type VerifyingReader struct {
+	Details          *openpgp.MessageDetails
+	RequireSignature bool
+	err              error
+}
+
+func (r *VerifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.Details.UnverifiedBody.Read(p)
+	if err != io.EOF {
+		return n, err
+	}
+	r.err = r.Check()
+	if r.err != nil {
+		log.Println(r.err)
+		return n, r.err
+	}
+	return n, io.EOF
+}
+
+func (r *VerifyingReader) Check() error {
+	if !r.RequireSignature {
+		return nil
+	}
+	if !r.Details.IsSigned {
+		return fmt.Errorf("%w: message is not signed", ErrSignature)
+	}
+	if r.Details.SignedBy == nil {
+		return fmt.Errorf("%w: unknown signer %X", ErrSignature, r.Details.SignedByKeyId)
+	}
+	if r.Details.SignatureError != nil {
+		return fmt.Errorf("%w: %v", ErrSignature, r.Details.SignatureError)
+	}
+	return nil
+}
+
+func Encrypt(in io.Reader, target job.JobTarget) (io.ReadCloser, error) {
+	recipients, err := configuration.GetKeyRing(target.EncryptKeys)
+	if err != nil {
+		return nil, err
+	}
+	var signer *openpgp.Entity
+	if target.SignKey != "" {
+		signers, err := configuration.GetKey(target.SignKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(signers) == 0 || signers[0].PrivateKey == nil {
+			return nil, fmt.Errorf("no private key to sign with: %s", target.SignKey)
+		}
+		signer = signers[0]
+	}
+	return Pipe(func(out io.Writer) error {
+		var armorWriter io.WriteCloser
+		if target.Armor {
+			encoder, err := armor.Encode(out, "PGP MESSAGE", nil)
+			if err != nil {
+				return err
+			}
+			armorWriter = encoder
+			out = encoder
+		}
+		writer, err := openpgp.Encrypt(out, recipients, signer, &openpgp.FileHints{IsBinary: true}, nil)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, in)
+		if err != nil {
+			return err
+		}
+		err = writer.Close()
+		if err != nil {
+			return err
+		}
+		if armorWriter != nil {
+			return armorWriter.Close()
+		}
+		return nil
+	}), nil
+}
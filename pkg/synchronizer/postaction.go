@@ -0,0 +1,122 @@
+package synchronizer
+
+import (
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/filter"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+// NOTE post actions run only after every target has been delivered and verified
+func PostAction(transferObj transfer.Transfer) error {
+	action := transferObj.Job.Source.GetPostAction()
+	log.Println("running source post action:", action)
+	switch action {
+	case job.PostActionNone:
+		return nil
+	case job.PostActionDelete:
+		return Delete(transferObj)
+	case job.PostActionArchive:
+		return Archive(transferObj)
+	case job.PostActionRename:
+		return Rename(transferObj)
+	case job.PostActionTag:
+		return Tag(transferObj)
+	}
+	return fmt.Errorf("unknown post action: %s", action)
+}
+
+// NOTE the archive path is rendered like a target path from the original source name
+func Archive(transferObj transfer.Transfer) error {
+	postAction := transferObj.Job.Source.PostAction
+	archiveTarget := job.JobTarget{
+		Remote:  postAction.Remote,
+		Root:    postAction.Root,
+		Pattern: postAction.Pattern,
+	}
+	if archiveTarget.Remote == "" {
+		archiveTarget.Remote = transferObj.Job.Source.Remote
+	}
+	archivePath := path.Clean(path.Join(archiveTarget.Root, transferObj.File.Name))
+	if archiveTarget.Pattern != "" {
+		rawTransfer := transferObj
+		rawTransfer.Job.Source.Decompress = ""
+		rawTransfer.Job.Source.DecryptKeys = nil
+		rawTransfer.Job.Source.VerifyKeys = nil
+		// NOTE a bundle member is archived under its own name rather than the bundle name
+		rawTransfer.Files = nil
+		var err error
+		archivePath, err = GetTargetPath(rawTransfer, archiveTarget)
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("archiving source to:", archiveTarget.Remote, archivePath)
+	return MoveSource(transferObj, archiveTarget.Remote, archivePath)
+}
+
+func Rename(transferObj transfer.Transfer) error {
+	suffix := transferObj.Job.Source.PostAction.Suffix
+	if suffix == "" {
+		return fmt.Errorf("rename post action has no suffix")
+	}
+	renamedPath := GetSourcePath(transferObj) + suffix
+	log.Println("renaming source to:", renamedPath)
+	return MoveSource(transferObj, transferObj.Job.Source.Remote, renamedPath)
+}
+
+// NOTE a retried transfer may find the source already moved
+func MoveSource(transferObj transfer.Transfer, remote, dstPath string) error {
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	ctx = filter.SetUseFilter(ctx, false)
+	sourcePath := GetSourcePath(transferObj)
+	fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+	if err != nil {
+		return err
+	}
+	exists, err := Exists(ctx, fsrc, path.Base(sourcePath))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Println("source already moved:", sourcePath)
+		return nil
+	}
+	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", remote, path.Dir(dstPath)))
+	if err != nil {
+		return err
+	}
+	return operations.MoveFile(ctx, fdst, fsrc, path.Base(dstPath), path.Base(sourcePath))
+}
+
+// NOTE tags and metadata can only be applied to s3 sources
+func Tag(transferObj transfer.Transfer) error {
+	postAction := transferObj.Job.Source.PostAction
+	sourcePath := GetSourcePath(transferObj)
+	if len(postAction.Tags) > 0 {
+		tags, err := RenderValues(transferObj, postAction.Tags)
+		if err != nil {
+			return err
+		}
+		err = PutS3Tags(transferObj.Job.Source.Remote, sourcePath, tags)
+		if err != nil {
+			return err
+		}
+	}
+	if len(postAction.Metadata) > 0 {
+		metadata, err := RenderValues(transferObj, postAction.Metadata)
+		if err != nil {
+			return err
+		}
+		return PutS3Metadata(transferObj.Job.Source.Remote, sourcePath, metadata)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package synchronizer
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/configuration"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	DefaultChunkSize = 64 * 1024 * 1024
+	// NOTE s3 rejects parts smaller than 5 MiB other than the last
+	MinChunkSize = 5 * 1024 * 1024
+	// NOTE s3 allows at most 10000 parts per upload
+	MaxParts = 10000
+	// NOTE time kept back from the deadline to save the checkpoint and return
+	DeadlineMargin = time.Minute
+	// NOTE uploads idle for longer than this are treated as abandoned
+	DefaultUploadMaxAge = 24 * time.Hour
+)
+
+var ErrIncomplete = errors.New("transfer incomplete, resuming on redelivery")
+
+type UploadPart struct {
+	Number int64
+	ETag   string
+}
+
+// NOTE a checkpoint records a multipart upload so that a later invocation continues where the last one stopped
+type Checkpoint struct {
+	Remote    string
+	Bucket    string
+	Key       string
+	UploadID  string
+	ChunkSize int64
+	Size      int64
+	ModTime   int64
+	Parts     []UploadPart
+	Updated   int64
+}
+
+// NOTE only copies to s3 that are not server-side and span more than one chunk are resumable
+func IsResumable(transferObj transfer.Transfer, target job.JobTarget, fsrc, fdst fs.Fs, opts Options) bool {
+	if !target.Resumable || CanServerSideCopy(fsrc, fdst) {
+		return false
+	}
+	if opts.Store == nil {
+		log.Println("no state store, copying without resume:", target.Remote)
+		return false
+	}
+	remoteType, _ := config.FileGetFlag(target.Remote, "type")
+	return remoteType == "s3" && transferObj.File.Size > GetChunkSize(target, transferObj.File.Size)
+}
+
+// NOTE the chunk size grows when needed to keep the upload within the part limit
+func GetChunkSize(target job.JobTarget, size int64) int64 {
+	chunkSize := target.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < MinChunkSize {
+		chunkSize = MinChunkSize
+	}
+	for size/chunkSize >= MaxParts {
+		chunkSize *= 2
+	}
+	return chunkSize
+}
+
+func GetCheckpointKey(transferObj transfer.Transfer, target job.JobTarget) string {
+	return path.Join("uploads", GetTransferHash(transferObj)+"-"+GetTargetHash(target))
+}
+
+// NOTE the source is read in ranges and each part is checked by s3 against its md5 as it is received
+// NOTE the checkpoint is saved after every part and the copy stops when the deadline is near
+// NOTE the checkpoint is keyed by source and target so that an upload resumes into the key it started with
+// NOTE an upload for a changed source or a moved bucket is aborted and started again
+// NOTE the returned name is the one the upload was written to and may differ from the rendered name
+func ResumableCopy(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, opts Options, fsrc, fdst fs.Fs, srcFileName, dstFileName string) (string, error) {
+	srcObj, err := fsrc.NewObject(ctx, srcFileName)
+	if err != nil {
+		return dstFileName, err
+	}
+	client, err := configuration.NewS3Client(target.Remote)
+	if err != nil {
+		return dstFileName, err
+	}
+	bucket, key := configuration.GetS3Location(path.Join(fdst.Root(), dstFileName))
+	checkpointKey := GetCheckpointKey(transferObj, target)
+	checkpoint, err := GetCheckpoint(opts.Store, checkpointKey)
+	if err != nil {
+		return dstFileName, err
+	}
+	if checkpoint != nil {
+		resumedFileName, ok := GetResumedName(fdst, checkpoint)
+		if !ok || checkpoint.Size != srcObj.Size() || checkpoint.ModTime != srcObj.ModTime(ctx).Unix() {
+			log.Println("checkpoint does not match, restarting upload:", checkpoint.Key)
+			err = AbortUpload(client, checkpoint)
+			if err != nil {
+				return dstFileName, err
+			}
+			checkpoint = nil
+		} else {
+			dstFileName = resumedFileName
+		}
+	}
+	if checkpoint == nil {
+		checkpoint, err = CreateUpload(ctx, client, target, bucket, key, srcObj.Size(), srcObj.ModTime(ctx).Unix())
+		if err != nil {
+			return dstFileName, err
+		}
+		err = PutCheckpoint(opts.Store, checkpointKey, checkpoint)
+		if err != nil {
+			return dstFileName, err
+		}
+	} else {
+		log.Println("resuming upload at part", len(checkpoint.Parts)+1, "of", GetPartCount(checkpoint), "into:", checkpoint.Key)
+	}
+	var lastPart time.Duration
+	for offset := int64(len(checkpoint.Parts)) * checkpoint.ChunkSize; offset < checkpoint.Size; offset += checkpoint.ChunkSize {
+		if !opts.Deadline.IsZero() && time.Until(opts.Deadline) < DeadlineMargin+lastPart {
+			log.Println("deadline near, stopping upload at part", len(checkpoint.Parts)+1, "of", GetPartCount(checkpoint))
+			return dstFileName, ErrIncomplete
+		}
+		started := time.Now()
+		part, err := PutPart(ctx, client, checkpoint, srcObj, offset)
+		if err != nil {
+			return dstFileName, err
+		}
+		checkpoint.Parts = append(checkpoint.Parts, part)
+		err = PutCheckpoint(opts.Store, checkpointKey, checkpoint)
+		if err != nil {
+			return dstFileName, err
+		}
+		lastPart = time.Since(started)
+	}
+	err = CompleteUpload(client, checkpoint)
+	if err != nil {
+		return dstFileName, err
+	}
+	err = opts.Store.Delete(checkpointKey)
+	if err != nil {
+		return dstFileName, err
+	}
+	dstObj, err := fdst.NewObject(ctx, dstFileName)
+	if err != nil {
+		return dstFileName, err
+	}
+	if dstObj.Size() != srcObj.Size() {
+		log.Println("size mismatch, deleting target:", dstObj.Remote())
+		err = operations.DeleteFile(ctx, dstObj)
+		if err != nil {
+			return dstFileName, err
+		}
+		return dstFileName, fmt.Errorf("size mismatch: %s", dstObj.Remote())
+	}
+	if !target.Verify {
+		return dstFileName, nil
+	}
+	hashTypes, err := GetHashTypes(target.Hashes)
+	if err != nil {
+		return dstFileName, err
+	}
+	return dstFileName, Verify(ctx, srcObj, dstObj, hashTypes)
+}
+
+// NOTE the upload key of a checkpoint is named relative to the target root so that it can be published
+func GetResumedName(fdst fs.Fs, checkpoint *Checkpoint) (string, bool) {
+	bucket, root := configuration.GetS3Location(fdst.Root())
+	if checkpoint.Bucket != bucket {
+		return "", false
+	}
+	if root == "" {
+		return checkpoint.Key, true
+	}
+	if !strings.HasPrefix(checkpoint.Key, root+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(checkpoint.Key, root+"/"), true
+}
+
+func GetPartCount(checkpoint *Checkpoint) int64 {
+	return (checkpoint.Size + checkpoint.ChunkSize - 1) / checkpoint.ChunkSize
+}
+
+// NOTE the mod time is stored where rclone keeps it so that the target reports it like any other upload
+func CreateUpload(ctx context.Context, client *s3.S3, target job.JobTarget, bucket, key string, size, modTime int64) (*Checkpoint, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	SetUploadHeaders(ctx, input)
+	if input.Metadata == nil {
+		input.Metadata = map[string]*string{}
+	}
+	input.Metadata["mtime"] = aws.String(strconv.FormatInt(modTime, 10))
+	storageClass := target.StorageClass
+	if storageClass == "" {
+		storageClass, _ = config.FileGetFlag(target.Remote, "storage_class")
+	}
+	if storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+	output, err := client.CreateMultipartUpload(input)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("started multipart upload:", bucket, key)
+	return &Checkpoint{
+		Remote:    target.Remote,
+		Bucket:    bucket,
+		Key:       key,
+		UploadID:  aws.StringValue(output.UploadId),
+		ChunkSize: GetChunkSize(target, size),
+		Size:      size,
+		ModTime:   modTime,
+		Parts:     []UploadPart{},
+	}, nil
+}
+
+func PutPart(ctx context.Context, client *s3.S3, checkpoint *Checkpoint, srcObj fs.Object, offset int64) (UploadPart, error) {
+	number := int64(len(checkpoint.Parts)) + 1
+	length := checkpoint.ChunkSize
+	if offset+length > checkpoint.Size {
+		length = checkpoint.Size - offset
+	}
+	reader, err := srcObj.Open(ctx, &fs.RangeOption{Start: offset, End: offset + length - 1})
+	if err != nil {
+		return UploadPart{}, err
+	}
+	defer reader.Close()
+	buffer := make([]byte, length)
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	sum := md5.Sum(buffer)
+	output, err := client.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(checkpoint.Bucket),
+		Key:           aws.String(checkpoint.Key),
+		UploadId:      aws.String(checkpoint.UploadID),
+		PartNumber:    aws.Int64(number),
+		ContentLength: aws.Int64(length),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		Body:          bytes.NewReader(buffer),
+	})
+	if err != nil {
+		return UploadPart{}, err
+	}
+	log.Println("uploaded part", number, "of", GetPartCount(checkpoint))
+	return UploadPart{number, aws.StringValue(output.ETag)}, nil
+}
+
+func CompleteUpload(client *s3.S3, checkpoint *Checkpoint) error {
+	parts := []*s3.CompletedPart{}
+	for _, part := range checkpoint.Parts {
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+	_, err := client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(checkpoint.Bucket),
+		Key:             aws.String(checkpoint.Key),
+		UploadId:        aws.String(checkpoint.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// NOTE an upload that s3 no longer knows has already been aborted or completed
+func AbortUpload(client *s3.S3, checkpoint *Checkpoint) error {
+	log.Println("aborting multipart upload:", checkpoint.Bucket, checkpoint.Key)
+	_, err := client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(checkpoint.Bucket),
+		Key:      aws.String(checkpoint.Key),
+		UploadId: aws.String(checkpoint.UploadID),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+		return nil
+	}
+	return err
+}
+
+func GetCheckpoint(store *state.Store, key string) (*Checkpoint, error) {
+	value, err := store.Get(key)
+	if err == state.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	err = json.Unmarshal(value, checkpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", key, err)
+	}
+	return checkpoint, nil
+}
+
+func PutCheckpoint(store *state.Store, key string, checkpoint *Checkpoint) error {
+	checkpoint.Updated = time.Now().Unix()
+	value, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return store.Put(key, value)
+}
+
+// NOTE uploads not updated within the max age are abandoned, eg when the message went to the dead letter queue
+// NOTE an abort incomplete multipart upload lifecycle rule on target buckets is still advised
+func CleanupUploads(store *state.Store, maxAge time.Duration) error {
+	keys, err := store.List("uploads")
+	if err != nil {
+		return err
+	}
+	for _, name := range keys {
+		key := path.Join("uploads", name)
+		checkpoint, err := GetCheckpoint(store, key)
+		if err != nil {
+			return err
+		}
+		if checkpoint == nil || time.Since(time.Unix(checkpoint.Updated, 0)) < maxAge {
+			continue
+		}
+		client, err := configuration.NewS3Client(checkpoint.Remote)
+		if err != nil {
+			return err
+		}
+		err = AbortUpload(client, checkpoint)
+		if err != nil {
+			return err
+		}
+		err = store.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
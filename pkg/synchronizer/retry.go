@@ -0,0 +1,158 @@
+package synchronizer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/tinkeractive/transferless/pkg/job"
+)
+
+type ErrorClass int
+
+const (
+	// NOTE retryable errors are retried with backoff and then left to queue redelivery
+	Retryable ErrorClass = iota
+	// NOTE permanent errors will fail the same way again so they are reported and not redelivered
+	Permanent
+	// NOTE fatal errors mean the invocation cannot continue so the transfer is not retried and is left to queue redelivery
+	Fatal
+	// NOTE deferred transfers hit a remote limit or ran out of time and are enqueued again with a delay
+	Deferred
+)
+
+const (
+	DefaultMaxAttempts    = 3
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+var PermanentAWSCodes = map[string]bool{
+	"AccessDenied":       true,
+	"NoSuchKey":          true,
+	"NoSuchBucket":       true,
+	"InvalidObjectState": true,
+}
+
+// NOTE credentials that expired or were rotated may be valid again for the next invocation so they are retried
+var CredentialAWSCodes = map[string]bool{
+	"InvalidAccessKeyId":    true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+}
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Fatal:
+		return "fatal"
+	case Deferred:
+		return "deferred"
+	}
+	return "retryable"
+}
+
+// NOTE a sync error is as severe as its most severe target failure
+// NOTE a deferred target outranks permanent failures so that it is still delivered later
+func Classify(err error) ErrorClass {
+	var syncErr *SyncError
+	if errors.As(err, &syncErr) {
+		result := Permanent
+		for _, failed := range syncErr.Failed() {
+			class := Classify(failed.Err)
+			if class == Fatal {
+				return Fatal
+			}
+			if class == Retryable || (class == Deferred && result == Permanent) {
+				result = class
+			}
+		}
+		return result
+	}
+	// NOTE an incomplete transfer is deferred so that resuming it does not count towards the redrive limit
+	if errors.Is(err, ErrDeferred) || errors.Is(err, ErrIncomplete) {
+		return Deferred
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		if CredentialAWSCodes[awsErr.Code()] {
+			return Retryable
+		}
+		if PermanentAWSCodes[awsErr.Code()] {
+			return Permanent
+		}
+	}
+	switch {
+	case fserrors.IsFatalError(err), errors.Is(err, context.Canceled):
+		return Fatal
+	case errors.Is(err, fs.ErrorObjectNotFound),
+		errors.Is(err, fs.ErrorDirNotFound),
+		errors.Is(err, fs.ErrorPermissionDenied),
+		errors.Is(err, os.ErrNotExist),
+		errors.Is(err, os.ErrPermission),
+		errors.Is(err, ErrSignature),
+		errors.Is(err, ErrConflict),
+		errors.Is(err, ErrArchiveLimit),
+		errors.Is(err, ErrArchiveSource),
+		fserrors.IsNoRetryError(err):
+		return Permanent
+	}
+	return Retryable
+}
+
+// NOTE only retryable errors are retried and the wait is a random share of the exponential backoff
+func WithRetry(retry job.JobRetry, fn func() error) error {
+	maxAttempts, initialBackoff, maxBackoff, err := GetRetryLimits(retry)
+	if err != nil {
+		return err
+	}
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		class := Classify(err)
+		if class != Retryable || attempt >= maxAttempts {
+			return err
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		log.Println("attempt", attempt, "failed, retrying in", wait, "-", err)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func GetRetryLimits(retry job.JobRetry) (int, time.Duration, time.Duration, error) {
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	initialBackoff := DefaultInitialBackoff
+	if retry.InitialBackoff != "" {
+		duration, err := time.ParseDuration(retry.InitialBackoff)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		initialBackoff = duration
+	}
+	maxBackoff := DefaultMaxBackoff
+	if retry.MaxBackoff != "" {
+		duration, err := time.ParseDuration(retry.MaxBackoff)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		maxBackoff = duration
+	}
+	return maxAttempts, initialBackoff, maxBackoff, nil
+}
@@ -0,0 +1,120 @@
+package synchronizer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/tinkeractive/transferless/pkg/notifier"
+	"github.com/tinkeractive/transferless/pkg/run"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+// NOTE the files of a bundle are loaded before it is synchronized so that its hash and members match the compile
+func LoadMembers(transferObj transfer.Transfer, store *state.Store) (transfer.Transfer, error) {
+	if transferObj.Members == "" || len(transferObj.Files) > 0 {
+		return transferObj, nil
+	}
+	if store == nil {
+		return transferObj, errors.New("bundle members require a state store")
+	}
+	files, err := run.GetMembers(store, transferObj.Members)
+	if err != nil {
+		return transferObj, fmt.Errorf("loading bundle members %s: %w", transferObj.Members, err)
+	}
+	transferObj.Files = files
+	return transferObj, nil
+}
+
+// NOTE the process time is taken when a transfer is first synchronized and kept under its hash
+// NOTE so that retries and redeliveries render the same target path
+func SetProcessTime(transferObj transfer.Transfer, store *state.Store) (transfer.Transfer, error) {
+	if transferObj.ProcessTime != 0 {
+		return transferObj, nil
+	}
+	transferObj.ProcessTime = time.Now().Unix()
+	if store == nil {
+		return transferObj, nil
+	}
+	key := path.Join("process", GetTransferHash(transferObj))
+	value, err := store.Get(key)
+	if err == state.ErrNotFound {
+		return transferObj, store.Put(key, []byte(strconv.FormatInt(transferObj.ProcessTime, 10)))
+	}
+	if err != nil {
+		return transferObj, err
+	}
+	transferObj.ProcessTime, err = strconv.ParseInt(string(value), 10, 64)
+	return transferObj, err
+}
+
+// NOTE called once a transfer has succeeded or failed for good so that the run can be completed
+// NOTE delivered and failed files are notified whether or not the transfer belongs to a run
+func FinishTransfer(transferObj transfer.Transfer, opts Options, transferErr error) error {
+	if transferErr == nil && transferObj.Operation == "" && notifier.IsNotified(transferObj.Job, notifier.EventFileDelivered) {
+		event := notifier.NewEvent(notifier.EventFileDelivered, transferObj.Job.Name, fmt.Sprintf("delivered %s", transferObj.File.Name))
+		event.RunID = transferObj.RunID
+		event.File = transferObj.File.Name
+		err := notifier.Notify(transferObj.Job, event)
+		if err != nil {
+			log.Println("failed to notify delivery:", err)
+		}
+	}
+	if transferErr != nil && notifier.IsNotified(transferObj.Job, notifier.EventFileFailed) {
+		event := notifier.NewEvent(notifier.EventFileFailed, transferObj.Job.Name, fmt.Sprintf("failed %s: %s", transferObj.File.Name, transferErr))
+		event.RunID = transferObj.RunID
+		event.File = transferObj.File.Name
+		err := notifier.Notify(transferObj.Job, event)
+		if err != nil {
+			log.Println("failed to notify failure:", err)
+		}
+	}
+	if transferObj.RunID == "" || opts.Store == nil {
+		return nil
+	}
+	record := run.TransferRecord{
+		Key:      GetTransferHash(transferObj),
+		File:     transferObj.File.Name,
+		Sequence: transferObj.Sequence,
+		Size:     transferObj.File.Size,
+		Status:   run.StatusSucceeded,
+		Finished: time.Now().Unix(),
+	}
+	if transferErr != nil {
+		record.Status = run.StatusFailed
+		record.Error = transferErr.Error()
+	}
+	err := run.Finish(opts.Store, transferObj.RunID, record)
+	if err != nil {
+		return err
+	}
+	return CompleteRun(opts.Store, transferObj.RunID)
+}
+
+// NOTE the completion event delivers the manifests of the run and then notifies its outcome
+// NOTE notification failures are logged so that they do not fire the completion event again
+func CompleteRun(store *state.Store, runID string) error {
+	return run.Complete(store, runID, func(summary run.Summary) error {
+		err := WriteManifests(store, summary.Run)
+		if err != nil {
+			return err
+		}
+		eventType := notifier.EventRunSucceeded
+		if summary.Status == run.StatusFailed {
+			eventType = notifier.EventRunFailed
+		}
+		message := fmt.Sprintf("run %s %s: %d of %d transfers succeeded", summary.Run.ID, summary.Status, summary.Succeeded, summary.Run.Expected)
+		event := notifier.NewEvent(eventType, summary.Run.Job.Name, message)
+		event.RunID = summary.Run.ID
+		event.Summary = notifier.NewSummary(summary, run.GetSummaryPath(store, summary.Run.ID))
+		err = notifier.Notify(summary.Run.Job, event)
+		if err != nil {
+			log.Println("failed to notify run:", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,123 @@
+package synchronizer
+
+import (
+	"net/url"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/tinkeractive/transferless/pkg/configuration"
+)
+
+// NOTE rclone has no api for object tags or metadata on existing objects so s3 is called directly
+func PutS3Tags(remote, objPath string, tags map[string]string) error {
+	client, err := configuration.NewS3Client(remote)
+	if err != nil {
+		return err
+	}
+	bucket, key := configuration.GetS3Location(objPath)
+	tagSet := []*s3.Tag{}
+	for _, tagKey := range SortedKeys(tags) {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(tagKey), Value: aws.String(tags[tagKey])})
+	}
+	_, err = client.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// NOTE s3 metadata can only be replaced by copying the object onto itself so existing metadata is merged in
+func PutS3Metadata(remote, objPath string, metadata map[string]string) error {
+	client, err := configuration.NewS3Client(remote)
+	if err != nil {
+		return err
+	}
+	bucket, key := configuration.GetS3Location(objPath)
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	merged := head.Metadata
+	if merged == nil {
+		merged = map[string]*string{}
+	}
+	for metaKey, value := range metadata {
+		merged[metaKey] = aws.String(value)
+	}
+	_, err = client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(bucket + "/" + key)),
+		ContentType:       head.ContentType,
+		Metadata:          merged,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		StorageClass:      head.StorageClass,
+	})
+	return err
+}
+
+func SortedKeys(values map[string]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func GetS3Metadata(remote, objPath string) (map[string]string, error) {
+	result := map[string]string{}
+	client, err := configuration.NewS3Client(remote)
+	if err != nil {
+		return result, err
+	}
+	bucket, key := configuration.GetS3Location(objPath)
+	head, err := client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return result, err
+	}
+	for metaKey, value := range head.Metadata {
+		result[metaKey] = aws.StringValue(value)
+	}
+	return result, nil
+}
+
+func GetS3Tags(remote, objPath string) (map[string]string, error) {
+	result := map[string]string{}
+	client, err := configuration.NewS3Client(remote)
+	if err != nil {
+		return result, err
+	}
+	bucket, key := configuration.GetS3Location(objPath)
+	output, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, tag := range output.TagSet {
+		result[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return result, nil
+}
+
+// NOTE s3 replaces the whole tag set so existing tags are merged in
+func AddS3Tags(remote, objPath string, tags map[string]string) error {
+	merged, err := GetS3Tags(remote, objPath)
+	if err != nil {
+		return err
+	}
+	for tagKey, value := range tags {
+		merged[tagKey] = value
+	}
+	return PutS3Tags(remote, objPath, merged)
+}
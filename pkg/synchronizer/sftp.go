@@ -0,0 +1,245 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fshttp"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NOTE transferless keeps the known hosts in the remote section because the synchronizer has no files of its own
+const KnownHostsKey = "transferless_known_hosts"
+
+// NOTE one client is kept per remote so that the files of a transfer share a connection
+var (
+	SFTPClients     = map[string]*sftp.Client{}
+	SFTPClientsLock sync.Mutex
+)
+
+// NOTE rclone has no api for file modes or owners so sftp is called directly over one cached connection per remote
+// NOTE the connection is dialled like the rclone backend dials so that its timeouts and bind address apply
+func GetSFTPClient(ctx context.Context, remote string) (*sftp.Client, error) {
+	SFTPClientsLock.Lock()
+	defer SFTPClientsLock.Unlock()
+	if client, ok := SFTPClients[remote]; ok {
+		return client, nil
+	}
+	client, err := NewSFTPClient(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	SFTPClients[remote] = client
+	return client, nil
+}
+
+// NOTE a client whose call failed is dropped so that the next file dials again
+func CloseSFTPClient(remote string) {
+	SFTPClientsLock.Lock()
+	defer SFTPClientsLock.Unlock()
+	if client, ok := SFTPClients[remote]; ok {
+		client.Close()
+		delete(SFTPClients, remote)
+	}
+}
+
+// NOTE clients were dialled with the credentials of the config they were built from so they are closed when it is reloaded
+func CloseSFTPClients() {
+	SFTPClientsLock.Lock()
+	defer SFTPClientsLock.Unlock()
+	for remote, client := range SFTPClients {
+		client.Close()
+		delete(SFTPClients, remote)
+	}
+}
+
+// NOTE the client is built from the rclone remote config so that it uses the same credentials
+// NOTE host keys are always checked and a remote without known hosts is refused
+func NewSFTPClient(ctx context.Context, remote string) (*sftp.Client, error) {
+	remoteType, _ := config.FileGetFlag(remote, "type")
+	if remoteType != "sftp" {
+		return nil, fmt.Errorf("remote is not sftp: %s", remote)
+	}
+	host, _ := config.FileGetFlag(remote, "host")
+	user, _ := config.FileGetFlag(remote, "user")
+	port, _ := config.FileGetFlag(remote, "port")
+	if port == "" {
+		port = "22"
+	}
+	hostKeyCallback, err := GetHostKeyCallback(remote)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         fs.GetConfig(ctx).ConnectTimeout,
+	}
+	signer, err := GetSFTPSigner(remote)
+	if err != nil {
+		return nil, err
+	}
+	if signer != nil {
+		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(signer))
+	}
+	pass, _ := config.FileGetFlag(remote, "pass")
+	if pass != "" {
+		clearPass, err := obscure.Reveal(pass)
+		if err != nil {
+			return nil, err
+		}
+		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(clearPass))
+	}
+	addr := net.JoinHostPort(host, port)
+	netConn, err := fshttp.NewDialer(ctx).Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, sshConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// NOTE the known hosts are the known hosts file of the rclone remote or known hosts lines in the remote section
+// NOTE the lines are written to a temp file only while they are parsed because they hold no secrets
+func GetHostKeyCallback(remote string) (ssh.HostKeyCallback, error) {
+	knownHostsFile, _ := config.FileGetFlag(remote, "known_hosts_file")
+	if knownHostsFile != "" {
+		return knownhosts.New(knownHostsFile)
+	}
+	knownHosts, _ := config.FileGetFlag(remote, KnownHostsKey)
+	if knownHosts == "" {
+		return nil, fmt.Errorf("no known hosts for sftp remote, set known_hosts_file or %s: %s", KnownHostsKey, remote)
+	}
+	// NOTE lines are stored on one line with escaped new lines like the pem key
+	unquoted, err := strconv.Unquote("\"" + knownHosts + "\"")
+	if err != nil {
+		return nil, err
+	}
+	tempFile, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.WriteString(unquoted)
+	if err != nil {
+		tempFile.Close()
+		return nil, err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.New(tempFile.Name())
+}
+
+// NOTE the pem key is stored on one line with escaped new lines, as in rclone
+func GetSFTPSigner(remote string) (ssh.Signer, error) {
+	keyPem, _ := config.FileGetFlag(remote, "key_pem")
+	keyFile, _ := config.FileGetFlag(remote, "key_file")
+	var key []byte
+	switch {
+	case keyPem != "":
+		unquoted, err := strconv.Unquote("\"" + keyPem + "\"")
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(unquoted)
+	case keyFile != "":
+		var err error
+		key, err = os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	keyFilePass, _ := config.FileGetFlag(remote, "key_file_pass")
+	if keyFilePass == "" {
+		return ssh.ParsePrivateKey(key)
+	}
+	clearPass, err := obscure.Reveal(keyFilePass)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(key, []byte(clearPass))
+}
+
+// NOTE the mode and owner are set on the published file
+func SetFileAttributes(target job.JobTarget, fdst fs.Fs, dstFileName string) error {
+	if target.Permissions == "" && target.Owner == "" {
+		return nil
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	client, err := GetSFTPClient(ctx, target.Remote)
+	if err != nil {
+		return err
+	}
+	filePath := path.Join(fdst.Root(), dstFileName)
+	if target.Permissions != "" {
+		mode, err := strconv.ParseUint(target.Permissions, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid permissions: %s", target.Permissions)
+		}
+		log.Println("setting permissions:", filePath, target.Permissions)
+		err = client.Chmod(filePath, os.FileMode(mode))
+		if err != nil {
+			CloseSFTPClient(target.Remote)
+			return err
+		}
+	}
+	if target.Owner != "" {
+		uid, gid, err := ParseOwner(target.Owner)
+		if err != nil {
+			return err
+		}
+		log.Println("setting owner:", filePath, target.Owner)
+		err = client.Chown(filePath, uid, gid)
+		if err != nil {
+			CloseSFTPClient(target.Remote)
+			return err
+		}
+	}
+	return nil
+}
+
+func ParseOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid owner, expected uid:gid: %s", owner)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid owner uid: %s", owner)
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid owner gid: %s", owner)
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,142 @@
+package synchronizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+)
+
+const (
+	SidecarChecksum = "checksum"
+	SidecarDone     = "done"
+)
+
+var DefaultSidecarPatterns = map[string]string{
+	SidecarChecksum: "{{.Path}}.{{.HashType}}",
+	SidecarDone:     "{{.Path}}.done",
+}
+
+// NOTE sidecars are written once the target is verified and published, checksums before done markers
+// NOTE so that a receiver which sees a done marker can rely on the checksums being present
+func WriteSidecars(target job.JobTarget, fdst fs.Fs, dstFileName string) error {
+	if len(target.Sidecars) == 0 {
+		return nil
+	}
+	for _, sidecar := range target.Sidecars {
+		if _, ok := DefaultSidecarPatterns[sidecar.Type]; !ok {
+			return fmt.Errorf("unknown sidecar type: %s", sidecar.Type)
+		}
+	}
+	// NOTE a new context keeps the upload headers of the target off its sidecars
+	ctx, err := NewContext()
+	if err != nil {
+		return err
+	}
+	var dstObj fs.Object
+	for _, sidecarType := range []string{SidecarChecksum, SidecarDone} {
+		for _, sidecar := range target.Sidecars {
+			if sidecar.Type != sidecarType {
+				continue
+			}
+			var content []byte
+			if sidecar.Type == SidecarChecksum {
+				if dstObj == nil {
+					dstObj, err = fdst.NewObject(ctx, dstFileName)
+					if err != nil {
+						return err
+					}
+				}
+				content, err = GetChecksumContent(ctx, dstObj, sidecar)
+				if err != nil {
+					return err
+				}
+			}
+			err = WriteSidecar(ctx, fdst, dstFileName, sidecar, content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func WriteSidecar(ctx context.Context, fdst fs.Fs, dstFileName string, sidecar job.JobSidecar, content []byte) error {
+	sidecarName, err := GetSidecarName(dstFileName, sidecar)
+	if err != nil {
+		return err
+	}
+	log.Println("writing sidecar:", sidecarName)
+	_, err = operations.Rcat(ctx, fdst, sidecarName, io.NopCloser(bytes.NewReader(content)), time.Now())
+	return err
+}
+
+// NOTE the name is rendered from the target name and is relative to the target directory
+func GetSidecarName(dstFileName string, sidecar job.JobSidecar) (string, error) {
+	pattern := sidecar.Pattern
+	if pattern == "" {
+		pattern = DefaultSidecarPatterns[sidecar.Type]
+	}
+	ext := path.Ext(dstFileName)
+	args := map[string]interface{}{
+		"Path":      dstFileName,
+		"Name":      strings.TrimSuffix(dstFileName, ext),
+		"Extension": strings.TrimPrefix(ext, "."),
+		"HashType":  GetSidecarHash(sidecar),
+	}
+	tmpl, err := template.New("sidecar").Funcs(PatternFuncs).Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, args)
+	if err != nil {
+		return "", err
+	}
+	result := path.Clean(buf.String())
+	if result == dstFileName {
+		return "", fmt.Errorf("sidecar would replace target: %s", result)
+	}
+	return result, nil
+}
+
+func GetSidecarHash(sidecar job.JobSidecar) string {
+	if sidecar.Hash == "" {
+		return "sha256"
+	}
+	return strings.ToLower(sidecar.Hash)
+}
+
+// NOTE the checksum is written in the format of sha256sum and md5sum so that receivers can check it with those tools
+// NOTE the backend hash is used when it has one, otherwise the target is read back and hashed
+func GetChecksumContent(ctx context.Context, dstObj fs.Object, sidecar job.JobSidecar) ([]byte, error) {
+	var hashType hash.Type
+	err := hashType.Set(GetSidecarHash(sidecar))
+	if err != nil {
+		return nil, err
+	}
+	sum := ""
+	if dstObj.Fs().Hashes().Contains(hashType) {
+		sum, err = dstObj.Hash(ctx, hashType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sum == "" {
+		sum, err = HashObject(ctx, dstObj, hashType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(fmt.Sprintf("%s  %s\n", sum, path.Base(dstObj.Remote()))), nil
+}
@@ -0,0 +1,346 @@
+package synchronizer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/state"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const (
+	DefaultSplitPattern = "{{.Name}}.part{{pad 3 .Part}}{{if .Extension}}.{{.Extension}}{{end}}"
+	SplitBufferSize     = 1 << 16
+)
+
+func IsSplit(target job.JobTarget) bool {
+	return target.Split != nil && (target.Split.Size > 0 || target.Split.Lines > 0)
+}
+
+// NOTE the conflict policy is applied to the name of the whole file that the part names are rendered from
+func SplitCopy(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, opts Options, fsrc, fdst fs.Fs, srcFileName, dstFileName string) error {
+	srcObj, err := fsrc.NewObject(ctx, srcFileName)
+	if err != nil {
+		return err
+	}
+	srcReader, err := NewSourceReader(ctx, transferObj, srcObj)
+	if err != nil {
+		return err
+	}
+	defer srcReader.Close()
+	in, err := NewLimitedReader(ctx, srcReader, transferObj, target, opts)
+	if err != nil {
+		return err
+	}
+	return DeliverParts(ctx, transferObj, target, opts, in, fdst, dstFileName, srcObj.ModTime(ctx))
+}
+
+// NOTE the content is transformed as a whole and then cut into parts that are compressed and encrypted on their own
+// NOTE so that every part can be read without the others, each part is published and recorded like a delivered file
+// NOTE every part is written under its temp name before any is published because a signature is only checked once
+// NOTE the whole source has been read, a source that fails to read to its end leaves no part published
+// NOTE the parts are recorded in the mirror together so that a redelivery only prunes the objects it did not write
+func DeliverParts(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, opts Options, in io.Reader, fdst fs.Fs, dstFileName string, modTime time.Time) error {
+	var content io.ReadCloser = io.NopCloser(in)
+	if target.Archive == "" && len(target.Transforms) > 0 {
+		var err error
+		content, err = Transform(in, target)
+		if err != nil {
+			return err
+		}
+	}
+	defer content.Close()
+	staged, err := StageParts(ctx, transferObj, target, content, fdst, dstFileName, modTime)
+	if err != nil {
+		return err
+	}
+	delivered := []string{}
+	for _, stagedPart := range staged {
+		if stagedPart.TempName != stagedPart.Name {
+			err = Publish(ctx, fdst, stagedPart.TempName, stagedPart.Name)
+			if err != nil {
+				return err
+			}
+		}
+		err = SetFileAttributes(target, fdst, stagedPart.Name)
+		if err != nil {
+			return err
+		}
+		err = WriteSidecars(target, fdst, stagedPart.Name)
+		if err != nil {
+			return err
+		}
+		err = RecordDelivery(transferObj, target, opts, fdst, stagedPart.Name, stagedPart.Result)
+		if err != nil {
+			return err
+		}
+		delivered = append(delivered, stagedPart.Name)
+	}
+	err = RecordMirror(transferObj, target, opts, fdst, delivered...)
+	if err != nil {
+		return err
+	}
+	return PruneParts(ctx, transferObj, target, opts, fdst, dstFileName, delivered)
+}
+
+type StagedPart struct {
+	Name     string
+	TempName string
+	Result   StreamResult
+}
+
+// NOTE parts already written under a temp name are deleted when a later part or the end of the source fails
+func StageParts(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, content io.Reader, fdst fs.Fs, dstFileName string, modTime time.Time) ([]StagedPart, error) {
+	partTarget := target
+	partTarget.Transforms = nil
+	splitter := NewSplitter(content, target.Split)
+	staged := []StagedPart{}
+	for part := 1; ; part++ {
+		partReader, err := splitter.Next()
+		if err == io.EOF {
+			return staged, nil
+		}
+		if err != nil {
+			return staged, DeleteStaged(ctx, fdst, staged, err)
+		}
+		partName, err := GetPartName(dstFileName, target.Split, part)
+		if err != nil {
+			return staged, DeleteStaged(ctx, fdst, staged, err)
+		}
+		stagedPart := StagedPart{Name: partName, TempName: GetTempName(transferObj, partName, target)}
+		staged = append(staged, stagedPart)
+		staged[len(staged)-1].Result, err = StreamTo(ctx, partTarget, partReader, fdst, stagedPart.TempName, modTime)
+		if err != nil {
+			return staged, DeleteStaged(ctx, fdst, staged, err)
+		}
+	}
+}
+
+// NOTE deletion is best effort and the staging error is returned
+func DeleteStaged(ctx context.Context, fdst fs.Fs, staged []StagedPart, stageErr error) error {
+	for _, stagedPart := range staged {
+		if stagedPart.TempName == stagedPart.Name {
+			continue
+		}
+		tempObj, err := fdst.NewObject(ctx, stagedPart.TempName)
+		if err != nil {
+			continue
+		}
+		log.Println("deleting staged part:", stagedPart.TempName)
+		err = operations.DeleteFile(ctx, tempObj)
+		if err != nil {
+			log.Println("failed to delete staged part:", err)
+		}
+	}
+	return stageErr
+}
+
+// NOTE the parts of a file are kept as a set so that a redelivery with fewer parts deletes the ones it did not write
+// NOTE the set is keyed by source and target because the part names can change between deliveries
+func GetPartSetKey(transferObj transfer.Transfer, target job.JobTarget) string {
+	sum := sha1.Sum([]byte(GetSourcePath(transferObj)))
+	return path.Join("parts", transferObj.Job.Name, hex.EncodeToString(sum[:])+"-"+GetTargetHash(target))
+}
+
+// NOTE stale parts are those of the previous set and the numbered parts that follow the last one written
+func PruneParts(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, opts Options, fdst fs.Fs, dstFileName string, delivered []string) error {
+	current := map[string]bool{}
+	partPaths := []string{}
+	for _, partName := range delivered {
+		partPath := path.Join(fdst.Root(), partName)
+		current[partPath] = true
+		partPaths = append(partPaths, partPath)
+	}
+	stale := []string{}
+	if opts.Store != nil {
+		value, err := opts.Store.Get(GetPartSetKey(transferObj, target))
+		if err != nil && err != state.ErrNotFound {
+			return err
+		}
+		previous := []string{}
+		if err == nil {
+			err = json.Unmarshal(value, &previous)
+			if err != nil {
+				return err
+			}
+		}
+		for _, partPath := range previous {
+			if !current[partPath] {
+				stale = append(stale, partPath)
+			}
+		}
+	}
+	for part := len(delivered) + 1; ; part++ {
+		partName, err := GetPartName(dstFileName, target.Split, part)
+		if err != nil {
+			return err
+		}
+		partPath := path.Join(fdst.Root(), partName)
+		_, err = fdst.NewObject(ctx, partName)
+		if err == fs.ErrorObjectNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !current[partPath] {
+			stale = append(stale, partPath)
+		}
+	}
+	for _, partPath := range stale {
+		err := DeleteTargetPath(ctx, target, partPath)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Store == nil {
+		return nil
+	}
+	value, err := json.Marshal(partPaths)
+	if err != nil {
+		return err
+	}
+	return opts.Store.Put(GetPartSetKey(transferObj, target), value)
+}
+
+// NOTE the part number starts at one and the name and extension are split at the first dot so that part numbers
+// NOTE come before compression and encryption extensions
+func GetPartName(dstFileName string, split *job.JobSplit, part int) (string, error) {
+	pattern := split.Pattern
+	if pattern == "" {
+		pattern = DefaultSplitPattern
+	}
+	base := path.Base(dstFileName)
+	name, ext := base, ""
+	if index := strings.Index(base, "."); index > 0 {
+		name, ext = base[:index], base[index+1:]
+	}
+	tmpl, err := template.New("part").Funcs(PatternFuncs).Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"Path":      dstFileName,
+		"Name":      name,
+		"Extension": ext,
+		"Part":      part,
+	})
+	if err != nil {
+		return "", err
+	}
+	result := path.Join(path.Dir(dstFileName), path.Clean(buf.String()))
+	if result == path.Clean(dstFileName) {
+		return "", fmt.Errorf("split pattern has no part number: %s", pattern)
+	}
+	return result, nil
+}
+
+// NOTE parts end on a line so that text is not cut within a record, only lines longer than the size or the buffer are cut
+// NOTE a part ends when it reaches either the size or the number of lines
+type Splitter struct {
+	Reader  *bufio.Reader
+	Size    int64
+	Lines   int
+	Pending []byte
+	Parts   int
+}
+
+func NewSplitter(in io.Reader, split *job.JobSplit) *Splitter {
+	return &Splitter{bufio.NewReaderSize(in, SplitBufferSize), split.Size, split.Lines, nil, 0}
+}
+
+// NOTE the previous part must be read to its end before the next one is requested
+// NOTE empty content is delivered as one empty part
+func (s *Splitter) Next() (io.Reader, error) {
+	if s.Parts > 0 && len(s.Pending) == 0 {
+		_, err := s.Reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.Parts++
+	return &PartReader{Splitter: s}, nil
+}
+
+// NOTE chunks are whole lines or the part of a line that fills the buffer
+func (s *Splitter) nextChunk() ([]byte, error) {
+	if len(s.Pending) > 0 {
+		chunk := s.Pending
+		s.Pending = nil
+		return chunk, nil
+	}
+	chunk, err := s.Reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || (err == io.EOF && len(chunk) > 0) {
+		err = nil
+	}
+	return append([]byte{}, chunk...), err
+}
+
+type PartReader struct {
+	Splitter *Splitter
+	Size     int64
+	Lines    int
+	Buffer   []byte
+	Done     bool
+}
+
+func (r *PartReader) Read(p []byte) (int, error) {
+	for len(r.Buffer) == 0 {
+		if r.Done {
+			return 0, io.EOF
+		}
+		err := r.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.Buffer)
+	r.Buffer = r.Buffer[n:]
+	return n, nil
+}
+
+func (r *PartReader) fill() error {
+	s := r.Splitter
+	chunk, err := s.nextChunk()
+	if err == io.EOF {
+		r.Done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.Size > 0 && r.Size+int64(len(chunk)) > s.Size {
+		if r.Size > 0 {
+			s.Pending = chunk
+			r.Done = true
+			return nil
+		}
+		s.Pending = chunk[s.Size:]
+		chunk = chunk[:s.Size]
+		r.Done = true
+	}
+	r.Size += int64(len(chunk))
+	r.Buffer = chunk
+	if chunk[len(chunk)-1] == '\n' {
+		r.Lines++
+		if s.Lines > 0 && r.Lines >= s.Lines {
+			r.Done = true
+		}
+	}
+	return nil
+}
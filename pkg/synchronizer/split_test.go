@@ -0,0 +1,90 @@
+package synchronizer
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+)
+
+func ReadParts(t *testing.T, content string, split *job.JobSplit) []string {
+	t.Helper()
+	splitter := NewSplitter(strings.NewReader(content), split)
+	parts := []string{}
+	for {
+		partReader, err := splitter.Next()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := io.ReadAll(partReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, string(part))
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		split   job.JobSplit
+		parts   []string
+	}{
+		{"empty", "", job.JobSplit{Size: 4}, []string{""}},
+		{"lines", "a\nb\nc\nd\ne\n", job.JobSplit{Lines: 2}, []string{"a\nb\n", "c\nd\n", "e\n"}},
+		{"lines exact", "a\nb\nc\nd\n", job.JobSplit{Lines: 2}, []string{"a\nb\n", "c\nd\n"}},
+		{"no final newline", "a\nb\nc", job.JobSplit{Lines: 2}, []string{"a\nb\n", "c"}},
+		{"size ends on line", "aa\nbb\ncc\n", job.JobSplit{Size: 7}, []string{"aa\nbb\n", "cc\n"}},
+		{"size cuts long line", "abcdefghij\nk\n", job.JobSplit{Size: 4}, []string{"abcd", "efgh", "ij\n", "k\n"}},
+		{"size and lines", "a\nb\nccc\n", job.JobSplit{Size: 5, Lines: 3}, []string{"a\nb\n", "ccc\n"}},
+		{"single part", "a\nb\n", job.JobSplit{Size: 100}, []string{"a\nb\n"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts := ReadParts(t, test.content, &test.split)
+			if !reflect.DeepEqual(parts, test.parts) {
+				t.Errorf("got %q, want %q", parts, test.parts)
+			}
+		})
+	}
+}
+
+func TestSplitterLongLine(t *testing.T) {
+	line := strings.Repeat("x", SplitBufferSize*2+10) + "\n"
+	parts := ReadParts(t, line+"y\n", &job.JobSplit{Lines: 1})
+	if len(parts) != 2 || parts[0] != line || parts[1] != "y\n" {
+		t.Errorf("line longer than the buffer was split: %d parts", len(parts))
+	}
+}
+
+func TestGetPartName(t *testing.T) {
+	tests := []struct {
+		dstFileName string
+		pattern     string
+		part        int
+		want        string
+	}{
+		{"out/data.csv.gz", "", 1, "out/data.part001.csv.gz"},
+		{"data", "", 12, "data.part012"},
+		{"out/data.csv", "{{.Name}}-{{.Part}}.{{.Extension}}", 2, "out/data-2.csv"},
+	}
+	for _, test := range tests {
+		got, err := GetPartName(test.dstFileName, &job.JobSplit{Pattern: test.pattern}, test.part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+	_, err := GetPartName("data.csv", &job.JobSplit{Pattern: "{{.Name}}.{{.Extension}}"}, 1)
+	if err == nil {
+		t.Error("pattern without part number was accepted")
+	}
+}
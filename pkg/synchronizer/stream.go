@@ -0,0 +1,269 @@
+package synchronizer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+// NOTE streamed transfers pass the content through the synchronizer instead of using a backend copy
+func IsStreamed(transferObj transfer.Transfer, target job.JobTarget) bool {
+	return IsTransformed(transferObj, target) || IsBandwidthLimited(transferObj, target) || IsSplit(target)
+}
+
+// NOTE transformed transfers deliver content that differs from the source
+func IsTransformed(transferObj transfer.Transfer, target job.JobTarget) bool {
+	source := transferObj.Job.Source
+	if IsDecrypted(source) || IsEncrypted(target) || len(target.Transforms) > 0 {
+		return true
+	}
+	return GetDecompression(source, transferObj.File.Name) != "" || target.Compress != ""
+}
+
+// NOTE rows are counted from the content after it is transformed and before it is compressed, -1 when not counted
+type StreamResult struct {
+	Rows int64
+	Sums map[hash.Type]string
+}
+
+func StreamCopy(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, opts Options, fsrc, fdst fs.Fs, srcFileName, dstFileName string) (StreamResult, error) {
+	srcObj, err := fsrc.NewObject(ctx, srcFileName)
+	if err != nil {
+		return StreamResult{Rows: -1}, err
+	}
+	srcReader, err := NewSourceReader(ctx, transferObj, srcObj)
+	if err != nil {
+		return StreamResult{Rows: -1}, err
+	}
+	defer srcReader.Close()
+	in, err := NewLimitedReader(ctx, srcReader, transferObj, target, opts)
+	if err != nil {
+		return StreamResult{Rows: -1}, err
+	}
+	return StreamTo(ctx, target, in, fdst, dstFileName, srcObj.ModTime(ctx))
+}
+
+// NOTE the content is delivered through the target path, temp name and publish steps of a copy
+func Deliver(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget, in io.Reader, modTime time.Time, opts Options) error {
+	targetPath, err := GetTargetPath(transferObj, target)
+	if err != nil {
+		return err
+	}
+	log.Println("target path:", targetPath)
+	in, err = NewLimitedReader(ctx, in, transferObj, target, opts)
+	if err != nil {
+		return err
+	}
+	ctx, _, err = WithTargetMetadata(ctx, transferObj, target, nil)
+	if err != nil {
+		return err
+	}
+	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", GetTargetRemote(target), path.Dir(targetPath)))
+	if err != nil {
+		return err
+	}
+	return WithConflictPolicy(ctx, transferObj, opts.Store, target, fdst, path.Base(targetPath), func(dstFileName string) error {
+		if IsSplit(target) {
+			return DeliverParts(ctx, transferObj, target, opts, in, fdst, dstFileName, modTime)
+		}
+		tempFileName := GetTempName(transferObj, dstFileName, target)
+		result, err := StreamTo(ctx, target, in, fdst, tempFileName, modTime)
+		if err != nil {
+			return err
+		}
+		if tempFileName != dstFileName {
+			err = Publish(ctx, fdst, tempFileName, dstFileName)
+			if err != nil {
+				return err
+			}
+		}
+		err = SetFileAttributes(target, fdst, dstFileName)
+		if err != nil {
+			return err
+		}
+		err = WriteSidecars(target, fdst, dstFileName)
+		if err != nil {
+			return err
+		}
+		err = RecordDelivery(transferObj, target, opts, fdst, dstFileName, result)
+		if err != nil {
+			return err
+		}
+		return RecordMirror(transferObj, target, opts, fdst, dstFileName)
+	})
+}
+
+// NOTE content is transformed before it is compressed, bundle archives are packed from the raw members so they are not transformed
+// NOTE the delivered content is hashed as it is written when it is verified or listed in a manifest
+func StreamTo(ctx context.Context, target job.JobTarget, in io.Reader, fdst fs.Fs, dstFileName string, modTime time.Time) (StreamResult, error) {
+	result := StreamResult{Rows: -1}
+	var content io.ReadCloser = io.NopCloser(in)
+	if target.Archive == "" && len(target.Transforms) > 0 {
+		var err error
+		content, err = Transform(in, target)
+		if err != nil {
+			return result, err
+		}
+	}
+	defer content.Close()
+	counter := &LineCounter{Reader: content}
+	dstReader, err := NewTargetReader(counter, target)
+	if err != nil {
+		return result, err
+	}
+	defer dstReader.Close()
+	hashes, err := GetStreamHashes(target)
+	if err != nil {
+		return result, err
+	}
+	var hasher *hash.MultiHasher
+	var reader io.Reader = dstReader
+	if hashes.Count() > 0 {
+		hasher, err = hash.NewMultiHasherTypes(hashes)
+		if err != nil {
+			return result, err
+		}
+		reader = io.TeeReader(dstReader, hasher)
+	}
+	log.Println("streaming to:", dstFileName)
+	dstObj, err := operations.Rcat(ctx, fdst, dstFileName, io.NopCloser(reader), modTime)
+	if err != nil {
+		return result, err
+	}
+	if target.Archive == "" {
+		result.Rows = counter.GetLines()
+	}
+	if hasher == nil {
+		return result, nil
+	}
+	result.Sums = hasher.Sums()
+	if !target.Verify {
+		return result, nil
+	}
+	hashTypes, err := GetHashTypes(target.Hashes)
+	if err != nil {
+		return result, err
+	}
+	return result, VerifySums(ctx, dstObj, result.Sums, hashTypes)
+}
+
+func GetStreamHashes(target job.JobTarget) (hash.Set, error) {
+	result := hash.NewHashSet()
+	if target.Verify {
+		verifyHashes, err := GetHashSet(target.Hashes)
+		if err != nil {
+			return result, err
+		}
+		result = verifyHashes
+	}
+	if target.Manifest != nil {
+		manifestHash, err := GetManifestHash(target.Manifest)
+		if err != nil {
+			return result, err
+		}
+		result.Add(manifestHash)
+	}
+	return result, nil
+}
+
+// NOTE sources are decrypted before they are decompressed and targets are compressed before they are encrypted
+func NewSourceReader(ctx context.Context, transferObj transfer.Transfer, srcObj fs.Object) (io.ReadCloser, error) {
+	reader, err := srcObj.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var in io.Reader = reader
+	closers := []io.Closer{reader}
+	source := transferObj.Job.Source
+	if IsDecrypted(source) {
+		in, err = Decrypt(in, source)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+	}
+	format := GetDecompression(source, srcObj.Remote())
+	if format != "" {
+		decompressReader, err := NewDecompressReader(in, format)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		in = decompressReader
+		closers = append([]io.Closer{decompressReader}, closers...)
+	}
+	return &ReadCloserChain{in, closers}, nil
+}
+
+func NewTargetReader(in io.Reader, target job.JobTarget) (io.ReadCloser, error) {
+	var result io.ReadCloser = io.NopCloser(in)
+	if target.Compress != "" {
+		compressReader, err := Compress(result, target.Compress)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result = &ReadCloserChain{compressReader, []io.Closer{compressReader, result}}
+	}
+	if IsEncrypted(target) {
+		encryptReader, err := Encrypt(result, target)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result = &ReadCloserChain{encryptReader, []io.Closer{encryptReader, result}}
+	}
+	return result, nil
+}
+
+// NOTE closers run in order so that wrapping readers are closed before the readers they wrap
+type ReadCloserChain struct {
+	io.Reader
+	Closers []io.Closer
+}
+
+func (r *ReadCloserChain) Close() error {
+	var result error
+	for _, closer := range r.Closers {
+		err := closer.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// NOTE a last line without a line ending is counted as well
+type LineCounter struct {
+	Reader   io.Reader
+	Lines    int64
+	Bytes    int64
+	LastByte byte
+}
+
+func (c *LineCounter) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if n > 0 {
+		c.Lines += int64(bytes.Count(p[:n], []byte("\n")))
+		c.Bytes += int64(n)
+		c.LastByte = p[n-1]
+	}
+	return n, err
+}
+
+func (c *LineCounter) GetLines() int64 {
+	if c.Bytes > 0 && c.LastByte != '\n' {
+		return c.Lines + 1
+	}
+	return c.Lines
+}
@@ -8,26 +8,72 @@ import (
 	"path"
 	"strings"
 	"text/template"
-	"time"
 
 	"github.com/rclone/rclone/cmd"
 	"github.com/rclone/rclone/fs"
 	"github.com/rclone/rclone/fs/filter"
 	"github.com/rclone/rclone/fs/operations"
-	"github.com/tinkeractive/transferless/pkg/file"
 	"github.com/tinkeractive/transferless/pkg/job"
 	"github.com/tinkeractive/transferless/pkg/transfer"
 )
 
-func Sync(transferObj transfer.Transfer) error {
-	for _, target := range transferObj.Job.Targets {
-		err := Copy(transferObj, target)
-		if err != nil {
+// NOTE targets are delivered concurrently and every target is attempted even when another fails
+func Sync(transferObj transfer.Transfer, opts Options) error {
+	if transferObj.Operation == transfer.OperationDelete {
+		return SyncDelete(transferObj, opts)
+	}
+	isBundle := len(transferObj.Files) > 0
+	deliver := func(target job.JobTarget) error {
+		if isBundle {
+			return Pack(transferObj, target, opts)
+		}
+		return Copy(transferObj, target, opts)
+	}
+	targets := transferObj.Job.Targets
+	indices := []int{}
+	for i := range targets {
+		indices = append(indices, i)
+	}
+	// NOTE the source may only be moved once every other target has a copy
+	postAction := transferObj.Job.Source.GetPostAction()
+	moveLast := postAction == job.PostActionDelete && !isBundle && len(targets) > 0
+	if moveLast {
+		indices = indices[:len(indices)-1]
+	}
+	results := FanOut(transferObj, indices, opts, deliver)
+	err := GetSyncError(results)
+	if err != nil {
+		return err
+	}
+	if postAction == job.PostActionNone {
+		return nil
+	}
+	if moveLast {
+		moved := false
+		result := DeliverTarget(transferObj, len(targets)-1, opts, func(target job.JobTarget) error {
+			var err error
+			moved, err = MoveIfServerSide(transferObj, target)
+			if err != nil || moved {
+				return err
+			}
+			return Copy(transferObj, target, opts)
+		})
+		err = GetSyncError(append(results, result))
+		if err != nil || moved {
 			return err
 		}
 	}
-	if transferObj.Job.Source.Delete {
-		err := Delete(transferObj)
+	if !isBundle {
+		return WithRetry(transferObj.Job.Retry, func() error {
+			return PostAction(transferObj)
+		})
+	}
+	for _, member := range transferObj.Files {
+		memberTransfer := transferObj
+		memberTransfer.File = member
+		err := WithRetry(transferObj.Job.Retry, func() error {
+			return PostAction(memberTransfer)
+		})
 		if err != nil {
 			return err
 		}
@@ -35,43 +81,220 @@ func Sync(transferObj transfer.Transfer) error {
 	return nil
 }
 
+// NOTE a delete reaches every target and never runs the source post action
+func SyncDelete(transferObj transfer.Transfer, opts Options) error {
+	indices := []int{}
+	for i := range transferObj.Job.Targets {
+		indices = append(indices, i)
+	}
+	results := FanOut(transferObj, indices, opts, func(target job.JobTarget) error {
+		return DeleteMirrored(transferObj, target, opts)
+	})
+	return GetSyncError(results)
+}
+
 func Delete(transferObj transfer.Transfer) error {
 	sourcePath := path.Clean(path.Join(transferObj.Job.Source.Root, transferObj.File.Name))
 	log.Println("deleting source path:", sourcePath)
 	sourceRemotePath := fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, sourcePath)
-	fs, srcFileName := cmd.NewFsFile(sourceRemotePath)
+	fsrc, srcFileName := cmd.NewFsFile(sourceRemotePath)
 	ctx, err := NewContext()
 	if err != nil {
 		return err
 	}
-	fileObj, err := fs.NewObject(ctx, srcFileName)
+	fileObj, err := fsrc.NewObject(ctx, srcFileName)
+	// NOTE a retried transfer may find the source already deleted or moved
+	if err == fs.ErrorObjectNotFound {
+		log.Println("source already deleted:", sourcePath)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 	return operations.DeleteFile(ctx, fileObj)
 }
 
-func Copy(transferObj transfer.Transfer, target job.JobTarget) error {
-	sourcePath := path.Clean(path.Join(transferObj.Job.Source.Root, transferObj.File.Name))
-	log.Println("source path:", sourcePath)
-	targetPath, err := GetTargetPath(transferObj.File, target)
+func Copy(transferObj transfer.Transfer, target job.JobTarget, opts Options) error {
+	if IsExtracted(transferObj) {
+		return Extract(transferObj, target, opts)
+	}
+	ctx, err := NewContext()
 	if err != nil {
 		return err
 	}
-	log.Println("target path:", targetPath)
-	ctx, err := NewContext()
+	ctx = filter.SetUseFilter(ctx, false)
+	fsrc, fdst, srcFileName, dstFileName, err := NewFsPair(ctx, transferObj, target)
 	if err != nil {
 		return err
 	}
-	fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+	var srcObj fs.Object
+	if target.PreserveMetadata {
+		srcObj, err = fsrc.NewObject(ctx, srcFileName)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, metadata, err := WithTargetMetadata(ctx, transferObj, target, srcObj)
+	if err != nil {
+		return err
+	}
+	return WithConflictPolicy(ctx, transferObj, opts.Store, target, fdst, dstFileName, func(dstFileName string) error {
+		if IsSplit(target) {
+			return SplitCopy(ctx, transferObj, target, opts, fsrc, fdst, srcFileName, dstFileName)
+		}
+		tempFileName := GetTempName(transferObj, dstFileName, target)
+		result := StreamResult{Rows: -1}
+		var err error
+		if IsStreamed(transferObj, target) {
+			result, err = StreamCopy(ctx, transferObj, target, opts, fsrc, fdst, srcFileName, tempFileName)
+		} else if IsResumable(transferObj, target, fsrc, fdst, opts) {
+			tempFileName, err = ResumableCopy(ctx, transferObj, target, opts, fsrc, fdst, srcFileName, tempFileName)
+		} else {
+			err = DirectCopy(ctx, target, fsrc, fdst, srcFileName, tempFileName)
+			if err == nil && CanServerSideCopy(fsrc, fdst) {
+				err = ApplyTargetMetadata(target, fdst, tempFileName, metadata)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if tempFileName != dstFileName {
+			err = Publish(ctx, fdst, tempFileName, dstFileName)
+			if err != nil {
+				return err
+			}
+		}
+		err = SetFileAttributes(target, fdst, dstFileName)
+		if err != nil {
+			return err
+		}
+		err = WriteSidecars(target, fdst, dstFileName)
+		if err != nil {
+			return err
+		}
+		err = RecordDelivery(transferObj, target, opts, fdst, dstFileName, result)
+		if err != nil {
+			return err
+		}
+		return RecordMirror(transferObj, target, opts, fdst, dstFileName)
+	})
+}
+
+func DirectCopy(ctx context.Context, target job.JobTarget, fsrc, fdst fs.Fs, srcFileName, dstFileName string) error {
+	if CanServerSideCopy(fsrc, fdst) {
+		log.Println("using server-side copy")
+	}
+	err := operations.CopyFile(ctx, fdst, fsrc, dstFileName, srcFileName)
+	if err != nil {
+		return err
+	}
+	if !target.Verify {
+		return nil
+	}
+	hashTypes, err := GetHashTypes(target.Hashes)
+	if err != nil {
+		return err
+	}
+	srcObj, err := fsrc.NewObject(ctx, srcFileName)
+	if err != nil {
+		return err
+	}
+	dstObj, err := fdst.NewObject(ctx, dstFileName)
+	if err != nil {
+		return err
+	}
+	return Verify(ctx, srcObj, dstObj, hashTypes)
+}
+
+// NOTE signatures are only checked at the end of the content so verified sources are always written under a temp name
+// NOTE and published once the whole message has been read
+func GetTempName(transferObj transfer.Transfer, fileName string, target job.JobTarget) string {
+	if target.TempPrefix == "" && target.TempSuffix == "" && len(transferObj.Job.Source.VerifyKeys) > 0 {
+		return fileName + DefaultTempSuffix
+	}
+	return target.TempPrefix + fileName + target.TempSuffix
+}
+
+// NOTE backends that cannot rename fall back to a copy of the temp file then delete
+func Publish(ctx context.Context, fdst fs.Fs, tempFileName, dstFileName string) error {
+	log.Println("publishing:", tempFileName, "as", dstFileName)
+	if fdst.Features().Move != nil {
+		return operations.MoveFile(ctx, fdst, fdst, dstFileName, tempFileName)
+	}
+	err := operations.CopyFile(ctx, fdst, fdst, dstFileName, tempFileName)
 	if err != nil {
 		return err
 	}
-	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", target.Remote, path.Dir(targetPath)))
+	tempObj, err := fdst.NewObject(ctx, tempFileName)
 	if err != nil {
 		return err
 	}
-	return operations.CopyFile(filter.SetUseFilter(ctx, false), fdst, fsrc, path.Base(targetPath), path.Base(sourcePath))
+	return operations.DeleteFile(ctx, tempObj)
+}
+
+// NOTE the move is atomic when the backend can rename, otherwise it is a server-side copy then delete
+// NOTE verified targets are copied and checked before the source is deleted
+// NOTE a move needs no temp name because the target appears in a single operation
+// NOTE targets with a conflict policy, attributes, sidecars or a manifest are copied so that they apply
+func MoveIfServerSide(transferObj transfer.Transfer, target job.JobTarget) (bool, error) {
+	if target.Verify || !IsOverwrite(target) || HasAttributes(target) || len(target.Sidecars) > 0 || target.Manifest != nil || IsStreamed(transferObj, target) || IsExtracted(transferObj) {
+		return false, nil
+	}
+	ctx, err := NewContext()
+	if err != nil {
+		return false, err
+	}
+	ctx = filter.SetUseFilter(ctx, false)
+	fsrc, fdst, srcFileName, dstFileName, err := NewFsPair(ctx, transferObj, target)
+	if err != nil {
+		return false, err
+	}
+	if !CanServerSideMove(fsrc, fdst) {
+		return false, nil
+	}
+	log.Println("using server-side move")
+	err = operations.MoveFile(ctx, fdst, fsrc, dstFileName, srcFileName)
+	return err == nil, err
+}
+
+func NewFsPair(ctx context.Context, transferObj transfer.Transfer, target job.JobTarget) (fs.Fs, fs.Fs, string, string, error) {
+	sourcePath := GetSourcePath(transferObj)
+	log.Println("source path:", sourcePath)
+	targetPath, err := GetTargetPath(transferObj, target)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	log.Println("target path:", targetPath)
+	fsrc, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", transferObj.Job.Source.Remote, path.Dir(sourcePath)))
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	fdst, err := fs.NewFs(ctx, fmt.Sprintf("%s:%s", GetTargetRemote(target), path.Dir(targetPath)))
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	return fsrc, fdst, path.Base(sourcePath), path.Base(targetPath), nil
+}
+
+func CanServerSideCopy(fsrc, fdst fs.Fs) bool {
+	if fdst.Features().Copy == nil {
+		return false
+	}
+	return IsSameStore(fsrc, fdst)
+}
+
+func CanServerSideMove(fsrc, fdst fs.Fs) bool {
+	if fdst.Features().Move == nil && fdst.Features().Copy == nil {
+		return false
+	}
+	return IsSameStore(fsrc, fdst)
+}
+
+func IsSameStore(fsrc, fdst fs.Fs) bool {
+	if operations.SameConfig(fsrc, fdst) {
+		return true
+	}
+	return operations.SameRemoteType(fsrc, fdst) && fdst.Features().ServerSideAcrossConfigs
 }
 
 func GetSourcePath(transferObj transfer.Transfer) string {
@@ -80,27 +303,80 @@ func GetSourcePath(transferObj transfer.Transfer) string {
 	return result
 }
 
-func GetTargetPath(source file.File, target job.JobTarget) (string, error) {
+// NOTE the base name of the source without the extensions of its decryption and decompression
+func GetDeliveredBase(transferObj transfer.Transfer) (string, error) {
+	source := transferObj.File
+	base := path.Base(source.Name)
+	if IsDecrypted(transferObj.Job.Source) {
+		base = TrimEncryptionExtension(base)
+	}
+	decompress := GetDecompression(transferObj.Job.Source, source.Name)
+	if decompress != "" {
+		decompressExt, err := GetCompressionExtension(decompress)
+		if err != nil {
+			return base, err
+		}
+		base = strings.TrimSuffix(base, "."+decompressExt)
+	}
+	return base, nil
+}
+
+func GetTargetPath(transferObj transfer.Transfer, target job.JobTarget) (string, error) {
 	result := ""
+	source := transferObj.File
 	dir := path.Dir(source.Name)
-	ext := path.Ext(source.Name)
-	name := strings.TrimSuffix(path.Base(source.Name), ext)
+	base, err := GetDeliveredBase(transferObj)
+	if err != nil {
+		return result, err
+	}
+	ext := path.Ext(base)
+	name := strings.TrimSuffix(base, ext)
 	ext = strings.TrimPrefix(ext, ".")
-	datetime := time.Unix(int64(source.LastModified), 0)
-	tmpl, err := template.New("FileName").Parse(target.Pattern)
+	if len(transferObj.Files) > 0 && target.Concatenate != nil {
+		memberTransfer := transferObj
+		memberTransfer.File = transferObj.Files[0]
+		memberBase, err := GetDeliveredBase(memberTransfer)
+		if err != nil {
+			return result, err
+		}
+		name = base
+		ext = strings.TrimPrefix(path.Ext(memberBase), ".")
+	} else if len(transferObj.Files) > 0 {
+		archiveExt, err := GetArchiveExtension(target.Archive)
+		if err != nil {
+			return result, err
+		}
+		name = base
+		ext = archiveExt
+	}
+	if target.Compress != "" {
+		compressExt, err := GetCompressionExtension(target.Compress)
+		if err != nil {
+			return result, err
+		}
+		ext = strings.TrimPrefix(ext+"."+compressExt, ".")
+	}
+	if IsEncrypted(target) {
+		ext = strings.TrimPrefix(ext+"."+GetEncryptionExtension(target), ".")
+	}
+	loc, err := GetLocation(target)
 	if err != nil {
 		return result, err
 	}
-	type FilePatternArgs struct {
-		Dir, Name, Extension, Date, Time string
+	datetime, err := GetTargetTime(transferObj, target, loc)
+	if err != nil {
+		return result, err
 	}
-	filePatternArgs := FilePatternArgs{
-		dir,
-		name,
-		ext,
-		datetime.Format(target.DateFormat),
-		datetime.Format(target.TimeFormat),
+	tmpl, err := template.New("FileName").Funcs(PatternFuncs).Parse(target.Pattern)
+	if err != nil {
+		return result, err
+	}
+	filePatternArgs, err := GetPatternArgs(transferObj, dir, name, ext, loc)
+	if err != nil {
+		return result, err
 	}
+	filePatternArgs["Date"] = datetime.Format(target.DateFormat)
+	filePatternArgs["Time"] = datetime.Format(target.TimeFormat)
 	var buf bytes.Buffer
 	err = tmpl.Execute(&buf, filePatternArgs)
 	if err != nil {
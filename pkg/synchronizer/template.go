@@ -0,0 +1,129 @@
+package synchronizer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"github.com/tinkeractive/transferless/pkg/transfer"
+)
+
+const ShortHashLength = 8
+
+// NOTE functions take the piped value last so that eg {{.Name | replace "-" "_"}} reads left to right
+var PatternFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"regexReplace": func(expr, repl, s string) (string, error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+	"pad": func(width int, value interface{}) string {
+		return fmt.Sprintf("%0*v", width, value)
+	},
+	"formatTime": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+}
+
+// NOTE named capture groups of the source pattern are added as fields but never replace the built in fields
+// NOTE every field is derived from the transfer so that retries and redeliveries render the same target path
+// NOTE the process time is set once per transfer by the synchronizer and is the run time when it was not set
+func GetPatternArgs(transferObj transfer.Transfer, dir, name, ext string, loc *time.Location) (map[string]interface{}, error) {
+	source := transferObj.File
+	modTime := time.Unix(source.LastModified, 0).In(loc)
+	runTime := time.Unix(transferObj.RunTime, 0).In(loc)
+	processTime := runTime
+	if transferObj.ProcessTime != 0 {
+		processTime = time.Unix(transferObj.ProcessTime, 0).In(loc)
+	}
+	args := map[string]interface{}{}
+	captures, err := job.GetCaptures(transferObj.Job.Source.Pattern, source.Name)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range captures {
+		args[key] = value
+	}
+	builtins := map[string]interface{}{
+		"Dir":         dir,
+		"Name":        name,
+		"Extension":   ext,
+		"Job":         transferObj.Job.Name,
+		"Remote":      transferObj.Job.Source.Remote,
+		"Size":        source.Size,
+		"Hash":        GetShortHash(transferObj),
+		"UUID":        GetUUID(transferObj),
+		"Sequence":    transferObj.Sequence,
+		"ModTime":     modTime,
+		"RunTime":     runTime,
+		"ProcessTime": processTime,
+	}
+	for key, value := range builtins {
+		args[key] = value
+	}
+	return args, nil
+}
+
+// NOTE values are rendered with the fields and functions of target patterns from the source name
+func RenderValues(transferObj transfer.Transfer, values map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+	fileName := transferObj.File.Name
+	ext := path.Ext(fileName)
+	name := strings.TrimSuffix(path.Base(fileName), ext)
+	args, err := GetPatternArgs(transferObj, path.Dir(fileName), name, strings.TrimPrefix(ext, "."), time.UTC)
+	if err != nil {
+		return result, err
+	}
+	for key, value := range values {
+		tmpl, err := template.New(key).Funcs(PatternFuncs).Parse(value)
+		if err != nil {
+			return result, err
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, args)
+		if err != nil {
+			return result, err
+		}
+		result[key] = buf.String()
+	}
+	return result, nil
+}
+
+// NOTE the source checksum is used when the compiler recorded one, otherwise the hash identifies the listing entry
+func GetShortHash(transferObj transfer.Transfer) string {
+	source := transferObj.File
+	sum := source.Hash
+	if sum == "" {
+		identity := fmt.Sprintf("%s:%s:%d:%d", transferObj.Job.Source.Remote, source.Name, source.Size, source.LastModified)
+		byt := sha1.Sum([]byte(identity))
+		sum = hex.EncodeToString(byt[:])
+	}
+	if len(sum) > ShortHashLength {
+		return sum[:ShortHashLength]
+	}
+	return sum
+}
+
+// NOTE the uuid is derived from the run and the file so that a redelivered transfer renders the same names
+func GetUUID(transferObj transfer.Transfer) string {
+	identity := fmt.Sprintf("%s:%d:%s:%s:%d", transferObj.RunID, transferObj.RunTime, transferObj.Job.Source.Remote, transferObj.File.Name, transferObj.Sequence)
+	sum := sha1.Sum([]byte(identity))
+	byt := sum[:16]
+	byt[6] = (byt[6] & 0x0f) | 0x50
+	byt[8] = (byt[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", byt[0:4], byt[4:6], byt[6:8], byt[8:10], byt[10:])
+}
@@ -0,0 +1,249 @@
+package synchronizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tinkeractive/transferless/pkg/job"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+const (
+	TransformLF          = "lf"
+	TransformCRLF        = "crlf"
+	TransformCharset     = "charset"
+	TransformStripHeader = "strip-header"
+	TransformDelimiter   = "delimiter"
+)
+
+// NOTE transformers wrap the stream so that content is changed as it passes without being held whole
+// NOTE a transformed reader that is also a closer is closed once the transfer ends
+type Transformer interface {
+	Transform(in io.Reader) (io.Reader, error)
+}
+
+type TransformerFunc func(in io.Reader) (io.Reader, error)
+
+func (f TransformerFunc) Transform(in io.Reader) (io.Reader, error) {
+	return f(in)
+}
+
+var Transformers = map[string]func(job.JobTransform) (Transformer, error){
+	TransformLF:          NewLFTransformer,
+	TransformCRLF:        NewCRLFTransformer,
+	TransformCharset:     NewCharsetTransformer,
+	TransformStripHeader: NewStripHeaderTransformer,
+	TransformDelimiter:   NewDelimiterTransformer,
+}
+
+func NewTransformer(spec job.JobTransform) (Transformer, error) {
+	newTransformer, ok := Transformers[spec.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform: %s", spec.Type)
+	}
+	return newTransformer(spec)
+}
+
+// NOTE transforms run in the order the target declares them
+func Transform(in io.Reader, target job.JobTarget) (io.ReadCloser, error) {
+	result := &ReadCloserChain{in, []io.Closer{}}
+	for _, spec := range target.Transforms {
+		transformer, err := NewTransformer(spec)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result.Reader, err = transformer.Transform(result.Reader)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		if closer, ok := result.Reader.(io.Closer); ok {
+			result.Closers = append([]io.Closer{closer}, result.Closers...)
+		}
+	}
+	return result, nil
+}
+
+func NewLFTransformer(spec job.JobTransform) (Transformer, error) {
+	return TransformerFunc(func(in io.Reader) (io.Reader, error) {
+		return transform.NewReader(in, &LineEndingTransformer{CRLF: false}), nil
+	}), nil
+}
+
+func NewCRLFTransformer(spec job.JobTransform) (Transformer, error) {
+	return TransformerFunc(func(in io.Reader) (io.Reader, error) {
+		return transform.NewReader(in, &LineEndingTransformer{CRLF: true}), nil
+	}), nil
+}
+
+// NOTE line endings are normalised so that crlf, lf and lone cr all become the chosen ending
+type LineEndingTransformer struct {
+	CRLF bool
+}
+
+func (t *LineEndingTransformer) Reset() {}
+
+func (t *LineEndingTransformer) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	nDst, nSrc := 0, 0
+	ending := []byte("\n")
+	if t.CRLF {
+		ending = []byte("\r\n")
+	}
+	for nSrc < len(src) {
+		c := src[nSrc]
+		if c != '\r' && c != '\n' {
+			if nDst >= len(dst) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			dst[nDst] = c
+			nDst++
+			nSrc++
+			continue
+		}
+		consumed := 1
+		if c == '\r' {
+			if nSrc+1 >= len(src) && !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			if nSrc+1 < len(src) && src[nSrc+1] == '\n' {
+				consumed = 2
+			}
+		}
+		if nDst+len(ending) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], ending)
+		nSrc += consumed
+	}
+	return nDst, nSrc, nil
+}
+
+// NOTE charsets are named as registered with iana, eg ISO-8859-1, windows-1252 or UTF-16LE, and default to UTF-8
+func NewCharsetTransformer(spec job.JobTransform) (Transformer, error) {
+	from, err := GetEncoding(spec.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := GetEncoding(spec.To)
+	if err != nil {
+		return nil, err
+	}
+	return TransformerFunc(func(in io.Reader) (io.Reader, error) {
+		return transform.NewReader(in, transform.Chain(from.NewDecoder(), to.NewEncoder())), nil
+	}), nil
+}
+
+// NOTE utf-16 without an explicit byte order uses the byte order mark and falls back to big endian
+func GetEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return unicode.UTF8, nil
+	case "utf-16", "utf16":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	}
+	result, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("unsupported charset: %s", name)
+	}
+	return result, nil
+}
+
+// NOTE one header line is stripped unless the transform sets the number of lines
+func NewStripHeaderTransformer(spec job.JobTransform) (Transformer, error) {
+	lines := spec.Lines
+	if lines <= 0 {
+		lines = 1
+	}
+	return TransformerFunc(func(in io.Reader) (io.Reader, error) {
+		return &HeaderStripper{bufio.NewReader(in), lines}, nil
+	}), nil
+}
+
+type HeaderStripper struct {
+	Reader    *bufio.Reader
+	Remaining int
+}
+
+func (r *HeaderStripper) Read(p []byte) (int, error) {
+	for r.Remaining > 0 {
+		_, err := r.Reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.Remaining--
+	}
+	return r.Reader.Read(p)
+}
+
+// NOTE records are parsed and written again so quoted fields keep their delimiters and quoting is normalised
+// NOTE records are written with lf endings, add a crlf transform after it when needed
+func NewDelimiterTransformer(spec job.JobTransform) (Transformer, error) {
+	from, err := GetDelimiter(spec.From, ',')
+	if err != nil {
+		return nil, err
+	}
+	to, err := GetDelimiter(spec.To, 0)
+	if err != nil {
+		return nil, err
+	}
+	return TransformerFunc(func(in io.Reader) (io.Reader, error) {
+		return Pipe(func(out io.Writer) error {
+			csvReader := csv.NewReader(in)
+			csvReader.Comma = from
+			csvReader.FieldsPerRecord = -1
+			csvReader.LazyQuotes = true
+			csvReader.ReuseRecord = true
+			csvWriter := csv.NewWriter(out)
+			csvWriter.Comma = to
+			for {
+				record, err := csvReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				err = csvWriter.Write(record)
+				if err != nil {
+					return err
+				}
+			}
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}), nil
+	}), nil
+}
+
+// NOTE a delimiter is a single character or the name tab
+func GetDelimiter(value string, defaultDelimiter rune) (rune, error) {
+	if value == "" {
+		if defaultDelimiter == 0 {
+			return 0, errors.New("no delimiter specified")
+		}
+		return defaultDelimiter, nil
+	}
+	if strings.EqualFold(value, "tab") || value == `\t` {
+		return '\t', nil
+	}
+	delimiter, size := utf8.DecodeRuneInString(value)
+	if size != len(value) || bytes.ContainsRune([]byte("\"\r\n"), delimiter) {
+		return 0, fmt.Errorf("invalid delimiter: %s", value)
+	}
+	return delimiter, nil
+}
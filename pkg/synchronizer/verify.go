@@ -0,0 +1,150 @@
+package synchronizer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/operations"
+)
+
+// NOTE hash types are tried in the order they are configured and these are tried when none are
+var DefaultHashes = []string{"md5", "sha1", "sha256"}
+
+func GetHashTypes(names []string) ([]hash.Type, error) {
+	result := []hash.Type{}
+	if len(names) == 0 {
+		names = DefaultHashes
+	}
+	for _, name := range names {
+		var hashType hash.Type
+		err := hashType.Set(name)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, hashType)
+	}
+	return result, nil
+}
+
+func GetHashSet(names []string) (hash.Set, error) {
+	hashTypes, err := GetHashTypes(names)
+	return hash.NewHashSet(hashTypes...), err
+}
+
+// NOTE a mismatched target is deleted so that corrupt data is never left in place
+func Verify(ctx context.Context, src, dst fs.Object, hashTypes []hash.Type) error {
+	equal, hashType, err := CompareHashes(ctx, src, dst, hashTypes)
+	if err != nil {
+		return err
+	}
+	return CheckVerified(ctx, dst, equal, hashType)
+}
+
+// NOTE sums are computed from the stream as it was written when the target content differs from the source
+func VerifySums(ctx context.Context, dst fs.Object, sums map[hash.Type]string, hashTypes []hash.Type) error {
+	equal, hashType, err := CompareSums(ctx, dst, sums, hashTypes)
+	if err != nil {
+		return err
+	}
+	return CheckVerified(ctx, dst, equal, hashType)
+}
+
+func CheckVerified(ctx context.Context, dst fs.Object, equal bool, hashType hash.Type) error {
+	if equal {
+		log.Println("verified", hashType, "checksum:", dst.Remote())
+		return nil
+	}
+	log.Println("checksum mismatch, deleting target:", dst.Remote())
+	err := operations.DeleteFile(ctx, dst)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%s checksum mismatch: %s", hashType, dst.Remote())
+}
+
+// NOTE the first hash in order of preference that both objects report is compared, otherwise the preferred one is computed
+func CompareHashes(ctx context.Context, src, dst fs.Object, hashTypes []hash.Type) (bool, hash.Type, error) {
+	common := src.Fs().Hashes().Overlap(dst.Fs().Hashes())
+	for _, hashType := range hashTypes {
+		if !common.Contains(hashType) {
+			continue
+		}
+		srcSum, err := src.Hash(ctx, hashType)
+		if err != nil {
+			return false, hashType, err
+		}
+		dstSum, err := dst.Hash(ctx, hashType)
+		if err != nil {
+			return false, hashType, err
+		}
+		// NOTE some objects cannot report a hash, eg s3 multipart uploads
+		if srcSum == "" || dstSum == "" {
+			continue
+		}
+		return srcSum == dstSum, hashType, nil
+	}
+	hashType := hashTypes[0]
+	srcSum, err := HashObject(ctx, src, hashType)
+	if err != nil {
+		return false, hashType, err
+	}
+	dstSum, err := HashObject(ctx, dst, hashType)
+	if err != nil {
+		return false, hashType, err
+	}
+	return srcSum == dstSum, hashType, nil
+}
+
+// NOTE only the hashes summed from the stream are compared, in the same order as CompareHashes
+func CompareSums(ctx context.Context, dst fs.Object, sums map[hash.Type]string, hashTypes []hash.Type) (bool, hash.Type, error) {
+	summed := []hash.Type{}
+	for _, hashType := range hashTypes {
+		if _, ok := sums[hashType]; ok {
+			summed = append(summed, hashType)
+		}
+	}
+	if len(summed) == 0 {
+		return false, hash.None, fmt.Errorf("no checksum was computed to verify: %s", dst.Remote())
+	}
+	supported := dst.Fs().Hashes()
+	for _, hashType := range summed {
+		if !supported.Contains(hashType) {
+			continue
+		}
+		dstSum, err := dst.Hash(ctx, hashType)
+		if err != nil {
+			return false, hashType, err
+		}
+		if dstSum == "" {
+			continue
+		}
+		return sums[hashType] == dstSum, hashType, nil
+	}
+	hashType := summed[0]
+	dstSum, err := HashObject(ctx, dst, hashType)
+	if err != nil {
+		return false, hashType, err
+	}
+	return sums[hashType] == dstSum, hashType, nil
+}
+
+func HashObject(ctx context.Context, obj fs.Object, hashType hash.Type) (string, error) {
+	hasher, err := hash.NewMultiHasherTypes(hash.NewHashSet(hashType))
+	if err != nil {
+		return "", err
+	}
+	reader, err := obj.Open(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return "", err
+	}
+	return hasher.Sums()[hashType], nil
+}
@@ -8,9 +8,23 @@ import (
 	"github.com/tinkeractive/transferless/pkg/job"
 )
 
+const OperationDelete = "delete"
+
+// NOTE a transfer with an operation does not copy its file, a delete removes what a mirrored job delivered from it
+// NOTE a transfer with files is a bundle of a compile run and its file describes the bundle as a whole
+// NOTE the files of an enqueued bundle are kept in the state store under the members key and loaded by the synchronizer
+// NOTE entries name the mirror entries of the file per target key so that they are read without listing the mirror
 type Transfer struct {
-	File file.File
-	Job  job.Job
+	File        file.File
+	Job         job.Job
+	Files       []file.File         `json:",omitempty"`
+	Members     string              `json:",omitempty"`
+	Sequence    int                 `json:",omitempty"`
+	RunTime     int64               `json:",omitempty"`
+	ProcessTime int64               `json:",omitempty"`
+	RunID       string              `json:",omitempty"`
+	Operation   string              `json:",omitempty"`
+	Entries     map[string][]string `json:",omitempty"`
 }
 
 func (t Transfer) String() string {